@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/db"
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/export"
+)
+
+const usage = `Usage: server [command]
+
+With no command the game server is started.
+
+Commands:
+  migrate [up]      apply pending database migrations
+  migrate status    list migrations and when they were applied
+  export [flags]    write match data to stdout or a file, see export -h
+  set-role USERNAME ROLE
+                    make a user a player, moderator or admin
+`
+
+// runCommand runs a CLI subcommand against the store instead of starting
+// the server
+func runCommand(store *db.Store, args []string) error {
+	switch args[0] {
+	case "migrate":
+		return runMigrate(store, args[1:])
+	case "export":
+		return runExport(store, args[1:])
+	case "set-role":
+		return runSetRole(store, args[1:])
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return nil
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+func runMigrate(store *db.Store, args []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	action := "up"
+	if len(args) > 0 {
+		action = args[0]
+	}
+
+	switch action {
+	case "up":
+		applied, err := store.Migrations.Migrate(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Applied %d migration(s)\n", len(applied))
+		return nil
+	case "status":
+		statuses, err := store.Migrations.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tAPPLIED\tDESCRIPTION")
+		for _, status := range statuses {
+			applied := "pending"
+			if status.Applied() {
+				applied = status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", status.Version, applied, status.Description)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown migrate action %q, expected up or status", action)
+	}
+}
+
+func runExport(store *db.Store, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	dataset := flags.String("dataset", string(export.DatasetMatches), "matches, results or actions")
+	format := flags.String("format", string(export.FormatCSV), "csv or ndjson")
+	from := flags.String("from", "", "only matches ending at or after this date (RFC 3339 or YYYY-MM-DD)")
+	to := flags.String("to", "", "only matches ending before this date, a bare date includes that day")
+	configKey := flags.String("config", "", "only matches played with this board config")
+	output := flags.String("o", "", "output file, defaults to stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	fromTime, toTime, err := export.ParseDateRange(*from, *to)
+	if err != nil {
+		return fmt.Errorf("invalid date range: %w", err)
+	}
+
+	options := export.Options{
+		Dataset:   export.Dataset(*dataset),
+		Format:    export.Format(*format),
+		From:      fromTime,
+		To:        toTime,
+		ConfigKey: *configKey,
+	}
+	if err := options.Validate(); err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	buffered := bufio.NewWriter(w)
+	if err := export.Write(context.Background(), buffered, store, options); err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
+
+// runSetRole changes a user's role directly in the store, which is how the
+// first admin is appointed. The user's sessions are revoked so their tokens
+// pick up the new role.
+func runSetRole(store *db.Store, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: set-role USERNAME ROLE")
+	}
+	username, role := args[0], db.Role(args[1])
+	if !role.Valid() {
+		return fmt.Errorf("unknown role %q, expected player, moderator or admin", role)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	user, err := store.Users.GetByUsername(ctx, username)
+	if err != nil {
+		return err
+	}
+
+	previous := user.Role
+	user.Role = role
+	user.UpdatedAt = time.Now()
+	if err := store.Users.Update(ctx, user); err != nil {
+		return err
+	}
+	if _, err := store.Sessions.RevokeAll(ctx, user.ID.Hex()); err != nil {
+		return err
+	}
+
+	fmt.Printf("Changed the role of %s from %q to %q\n", username, previous, role)
+	return nil
+}
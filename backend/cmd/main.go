@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"log"
 	"net/http"
 	"os"
@@ -13,35 +14,121 @@ import (
 	"github.com/gameoflife0880/web_minesweeper/backend/internal/db"
 	"github.com/gameoflife0880/web_minesweeper/backend/internal/game"
 	"github.com/gameoflife0880/web_minesweeper/backend/internal/handler"
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/mail"
 )
 
 const PORT = "8081"
 
 func main() {
-	// Initialize database connection
-	mongoURI := os.Getenv("MONGO_URI")
-	if err := db.Init(mongoURI, ""); err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+	// Initialize storage
+	store, err := db.Open(db.LoadConfig())
+	if err != nil {
+		log.Fatalf("Failed to open storage: %v", err)
 	}
-	defer db.Close()
+	defer store.Close()
 
-	hub := game.NewGameHub()
+	if len(os.Args) > 1 {
+		if err := runCommand(store, os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	migrateCtx, cancelMigrate := context.WithTimeout(context.Background(), time.Minute)
+	_, err = store.Migrations.Migrate(migrateCtx)
+	cancelMigrate()
+	if err != nil {
+		log.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	mailer, err := mail.New(mail.LoadConfig())
+	if err != nil {
+		log.Fatalf("Failed to configure mail: %v", err)
+	}
+
+	keys, err := auth.LoadKeys(auth.LoadKeyConfig())
+	if err != nil {
+		log.Fatalf("Failed to load JWT keys: %v", err)
+	}
+
+	authHandler := auth.NewHandler(store, mailer, keys)
+
+	hub := game.NewGameHub(game.LoadHubConfig(), store)
+	hub.ReservedName = authHandler.Rules.IsReserved
+	if err := hub.RestoreSnapshot(); err != nil {
+		log.Printf("Failed to restore room snapshot, starting a new round: %v", err)
+	}
 
 	go hub.Run()
 
+	// An explicit mux, as importing expvar registers /debug/vars on the
+	// default one
+	mux := http.NewServeMux()
+
 	// Auth routes
-	http.HandleFunc("/api/auth/register", auth.RegisterHandler)
-	http.HandleFunc("/api/auth/login", auth.LoginHandler)
-	http.HandleFunc("/api/auth/verify", auth.VerifyTokenHandler)
+	authHandler.OnSessionRevoked = hub.CloseSession
+	authHandler.OnUserDeleted = func(ctx context.Context, userID string) error {
+		// The live round goes first, so no round recorded afterwards can
+		// bring the account back into the history
+		anonymous := db.NewAnonymousPlayer()
+		if err := hub.ForgetPlayer(ctx, userID, anonymous); err != nil {
+			return err
+		}
+		return store.AnonymizeUser(ctx, userID, anonymous)
+	}
+	mux.HandleFunc("GET /.well-known/jwks.json", authHandler.JWKSHandler)
+	mux.HandleFunc("/api/auth/register", authHandler.RegisterHandler)
+	mux.HandleFunc("/api/auth/login", authHandler.LoginHandler)
+	mux.HandleFunc("/api/auth/verify", authHandler.VerifyTokenHandler)
+	mux.HandleFunc("/api/auth/refresh", authHandler.RefreshHandler)
+	mux.HandleFunc("/api/auth/logout", authHandler.LogoutHandler)
+	mux.HandleFunc("/api/auth/verify-email/send", authHandler.AuthMiddleware(authHandler.SendVerificationHandler))
+	mux.HandleFunc("/api/auth/verify-email", authHandler.VerifyEmailHandler)
+	mux.HandleFunc("/api/auth/password-reset/send", authHandler.RequestPasswordResetHandler)
+	mux.HandleFunc("/api/auth/password-reset", authHandler.ResetPasswordHandler)
+	mux.HandleFunc("GET /api/auth/oidc/providers", authHandler.OIDCProvidersHandler)
+	mux.HandleFunc("POST /api/auth/oidc/{provider}/start", authHandler.OptionalAuthMiddleware(authHandler.OIDCStartHandler))
+	mux.HandleFunc("POST /api/auth/oidc/{provider}/callback", authHandler.OIDCCallbackHandler)
+
+	// Account routes
+	mux.HandleFunc("GET /api/me", authHandler.AuthMiddleware(authHandler.MeHandler))
+	mux.HandleFunc("PATCH /api/me", authHandler.AuthMiddleware(authHandler.UpdateMeHandler))
+	mux.HandleFunc("DELETE /api/me", authHandler.AuthMiddleware(authHandler.DeleteMeHandler))
+	mux.HandleFunc("POST /api/me/password", authHandler.AuthMiddleware(authHandler.ChangePasswordHandler))
+
+	// Admin routes
+	mux.HandleFunc("PUT /api/users/{id}/role", authHandler.RequireRole(auth.RoleAdmin, authHandler.SetRoleHandler))
+	mux.HandleFunc("GET /api/metrics", authHandler.RequireRole(auth.RoleAdmin, expvar.Handler().ServeHTTP))
+
+	// Player routes
+	api := handler.NewAPI(store)
+	mux.HandleFunc("GET /api/users/{id}/stats", authHandler.OptionalAuthMiddleware(api.UserStatsHandler))
+	mux.HandleFunc("GET /api/users/{id}/matches", api.UserMatchesHandler)
+	mux.HandleFunc("GET /api/matches/{id}", api.MatchHandler)
+	mux.HandleFunc("GET /api/matches/{id}/board", api.MatchBoardHandler)
+	mux.HandleFunc("GET /api/leaderboard", authHandler.OptionalAuthMiddleware(api.LeaderboardHandler))
+	mux.HandleFunc("GET /api/export", authHandler.RequireRole(auth.RoleAdmin, api.ExportHandler))
+
+	// Room routes
+	mux.HandleFunc("GET /api/room/board", authHandler.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeBoard(hub, w, r)
+	}))
+	mux.HandleFunc("POST /api/room/board", authHandler.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		handler.LoadBoard(hub, w, r)
+	}))
+	mux.HandleFunc("POST /api/room/upgrade", authHandler.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		handler.UpgradeGuest(hub, authHandler, w, r)
+	}))
 
 	// WebSocket route
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		handler.ServeWs(hub, w, r)
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeWs(hub, authHandler, w, r)
 	})
+	mux.HandleFunc("GET /ws/replay/{id}", api.ServeReplay)
 
 	server := &http.Server{
 		Addr:    ":" + PORT,
-		Handler: nil,
+		Handler: mux,
 	}
 
 	go func() {
@@ -65,6 +152,7 @@ func main() {
 	}
 
 	close(hub.Shutdown())
+	<-hub.Done()
 
 	log.Println("Server exited")
 }
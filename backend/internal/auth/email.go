@@ -0,0 +1,400 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/db"
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/mail"
+)
+
+var (
+	ErrInvalidEmailToken = errors.New("invalid or expired email token")
+	ErrNoEmail           = errors.New("account has no email")
+	ErrEmailVerified     = errors.New("email is already verified")
+	ErrEmailRecentlySent = errors.New("a link was sent recently")
+)
+
+// DefaultAppURL is where the frontend is served during development
+const DefaultAppURL = "http://localhost:5173"
+
+type EmailTokenRequest struct {
+	Token string `json:"token"`
+}
+
+type PasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"newPassword"`
+}
+
+// GetAppURL returns the frontend URL that emailed links point to, from
+// APP_URL or DefaultAppURL
+func GetAppURL() string {
+	appURL := os.Getenv("APP_URL")
+	if appURL == "" {
+		return DefaultAppURL
+	}
+	return strings.TrimRight(appURL, "/")
+}
+
+// GetEmailVerificationTTL returns how long an email verification link is
+// valid, from EMAIL_VERIFICATION_TTL_HOURS or 48 hours by default
+func GetEmailVerificationTTL() time.Duration {
+	return envDuration("EMAIL_VERIFICATION_TTL_HOURS", time.Hour, 48*time.Hour)
+}
+
+// GetPasswordResetTTL returns how long a password reset link is valid, from
+// PASSWORD_RESET_TTL_MINUTES or 1 hour by default
+func GetPasswordResetTTL() time.Duration {
+	return envDuration("PASSWORD_RESET_TTL_MINUTES", time.Minute, time.Hour)
+}
+
+// SendVerificationHandler emails the caller a link to verify their email.
+// It expects to be wrapped in AuthMiddleware.
+func (h *Handler) SendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := GetUserIDFromContext(r.Context())
+	user, err := h.GetUserByID(userID)
+	if err != nil {
+		respondWithUserError(w, userID, err)
+		return
+	}
+
+	if user.Email != "" && !h.emailLimits.allow(user.Email, remoteIP(r)) {
+		respondWithError(w, http.StatusTooManyRequests, "Too many emails requested, try again later")
+		return
+	}
+
+	if err := h.SendVerification(user); err != nil {
+		switch err {
+		case ErrNoEmail:
+			respondWithError(w, http.StatusBadRequest, "Account has no email")
+		case ErrEmailVerified:
+			respondWithError(w, http.StatusConflict, "Email is already verified")
+		case ErrEmailRecentlySent:
+			// The link sent moments ago is still good
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			log.Printf("Error sending verification email to user %s: %v", userID, err)
+			respondWithError(w, http.StatusInternalServerError, "Failed to send verification email")
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// VerifyEmailHandler marks an email as verified using the token from a
+// verification link
+func (h *Handler) VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req EmailTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		respondWithError(w, http.StatusBadRequest, "Token is required")
+		return
+	}
+
+	user, err := h.VerifyEmail(req.Token)
+	if err != nil {
+		if err == ErrInvalidEmailToken {
+			respondWithError(w, http.StatusBadRequest, "Invalid or expired token")
+			return
+		}
+		log.Printf("Error verifying email: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify email")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, user)
+}
+
+// RequestPasswordResetHandler emails a password reset link if an account
+// has the given email. It always responds the same way, so it cannot be
+// used to find out which emails have accounts, even when the request is
+// throttled or a link was sent recently.
+func (h *Handler) RequestPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req PasswordResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		respondWithError(w, http.StatusBadRequest, "Email is required")
+		return
+	}
+
+	ip := remoteIP(r)
+	if !h.emailLimits.allow(req.Email, ip) {
+		log.Printf("Throttled password reset request from %s", ip)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	// Sending in the background keeps the response time the same whether
+	// or not the account exists
+	go func() {
+		err := h.SendPasswordReset(req.Email)
+		if err != nil && err != ErrUserNotFound && err != ErrEmailRecentlySent {
+			log.Printf("Error sending password reset email: %v", err)
+		}
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ResetPasswordHandler sets a new password using the token from a password
+// reset link, and logs the account out everywhere
+func (h *Handler) ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.Token == "" || req.NewPassword == "" {
+		respondWithError(w, http.StatusBadRequest, "Token and new password are required")
+		return
+	}
+
+	if err := h.ResetPassword(req.Token, req.NewPassword); err != nil {
+		var validationErr *ValidationError
+		if errors.As(err, &validationErr) {
+			respondWithValidationError(w, err)
+			return
+		}
+		if err == ErrInvalidEmailToken {
+			respondWithError(w, http.StatusBadRequest, "Invalid or expired token")
+			return
+		}
+		log.Printf("Error resetting password: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to reset password")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SendVerification emails a user a link to verify their current email
+func (h *Handler) SendVerification(user *User) error {
+	if user.Email == "" {
+		return ErrNoEmail
+	}
+	if user.EmailVerified {
+		return ErrEmailVerified
+	}
+
+	token, err := h.createEmailToken(user, db.PurposeVerifyEmail, GetEmailVerificationTTL())
+	if err != nil {
+		return err
+	}
+
+	return h.sendMail(mail.Message{
+		To:      user.Email,
+		Subject: "Verify your Minesweeper email",
+		Body: fmt.Sprintf("Hi %s,\n\nConfirm this is your email by opening the link below:\n\n%s\n\nThe link expires in %s. If you did not create a Minesweeper account you can ignore this email.\n",
+			user.Name(), emailLink("verify-email", token), describeDuration(GetEmailVerificationTTL())),
+	})
+}
+
+// sendVerificationInBackground sends a verification email without making
+// the request wait for the mail server
+func (h *Handler) sendVerificationInBackground(user *User) {
+	// The caller goes on to clear the password of its copy
+	recipient := *user
+	go func() {
+		if err := h.SendVerification(&recipient); err != nil && err != ErrEmailRecentlySent {
+			log.Printf("Error sending verification email to user %s: %v", recipient.ID.Hex(), err)
+		}
+	}()
+}
+
+// VerifyEmail consumes a verification token and returns the verified user.
+// The token is rejected if the email changed since it was sent.
+func (h *Handler) VerifyEmail(tokenString string) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := h.consumeEmailToken(ctx, tokenString, db.PurposeVerifyEmail)
+	if err != nil {
+		return nil, err
+	}
+
+	user.EmailVerified = true
+	user.UpdatedAt = time.Now()
+	if err := h.Users.Update(ctx, user); err != nil {
+		return nil, err
+	}
+
+	// Don't return password
+	user.Password = ""
+	return user, nil
+}
+
+// SendPasswordReset emails a password reset link to the account with the
+// given email, or returns ErrUserNotFound
+func (h *Handler) SendPasswordReset(email string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := h.Users.GetByEmail(ctx, email)
+	if err != nil {
+		return err
+	}
+
+	token, err := h.createEmailToken(user, db.PurposeResetPassword, GetPasswordResetTTL())
+	if err != nil {
+		return err
+	}
+
+	return h.sendMail(mail.Message{
+		To:      user.Email,
+		Subject: "Reset your Minesweeper password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your account %q. Choose a new password here:\n\n%s\n\nThe link expires in %s. If it was not you, you can ignore this email and your password will stay the same.\n",
+			user.Name(), user.Username, emailLink("reset-password", token), describeDuration(GetPasswordResetTTL())),
+	})
+}
+
+// ResetPassword consumes a password reset token, sets the new password and
+// revokes every session of the account
+func (h *Handler) ResetPassword(tokenString, newPassword string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Check what can be checked before the token is used up, so a rejected
+	// password can be retried with the same link
+	if err := h.Rules.ValidatePassword("newPassword", newPassword, ""); err != nil {
+		return err
+	}
+
+	user, err := h.consumeEmailToken(ctx, tokenString, db.PurposeResetPassword)
+	if err != nil {
+		return err
+	}
+	if err := h.Rules.ValidatePassword("newPassword", newPassword, user.Username); err != nil {
+		return err
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	user.Password = string(hashedPassword)
+	// Following the link proves the user can read the email
+	user.EmailVerified = true
+	user.UpdatedAt = time.Now()
+
+	if err := h.Users.Update(ctx, user); err != nil {
+		return err
+	}
+	h.loginLimits.forget(user.Username)
+
+	return h.revokeUserSessions(ctx, user.ID.Hex())
+}
+
+// createEmailToken issues a token to email to a user. It returns
+// ErrEmailRecentlySent if a token for the same purpose and address was
+// issued less than emailResendInterval ago.
+func (h *Handler) createEmailToken(user *User, purpose db.EmailTokenPurpose, ttl time.Duration) (string, error) {
+	now := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	latest, err := h.EmailTokens.Latest(ctx, user.ID.Hex(), purpose)
+	switch {
+	case err == nil && latest.Email == user.Email && now.Sub(latest.CreatedAt) < emailResendInterval:
+		return "", ErrEmailRecentlySent
+	case err != nil && !errors.Is(err, db.ErrEmailTokenNotFound):
+		return "", err
+	}
+
+	token, hash, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = h.EmailTokens.Create(ctx, &db.EmailToken{
+		Hash:      hash,
+		Purpose:   purpose,
+		UserID:    user.ID.Hex(),
+		Email:     user.Email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	})
+	return token, err
+}
+
+// consumeEmailToken uses up a token and returns its user, provided the
+// user's email is still the one the token was sent to
+func (h *Handler) consumeEmailToken(ctx context.Context, tokenString string, purpose db.EmailTokenPurpose) (*User, error) {
+	token, err := h.EmailTokens.Consume(ctx, hashToken(tokenString), purpose)
+	if err != nil {
+		if errors.Is(err, db.ErrEmailTokenNotFound) {
+			return nil, ErrInvalidEmailToken
+		}
+		return nil, err
+	}
+
+	user, err := h.Users.GetByID(ctx, token.UserID)
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			return nil, ErrInvalidEmailToken
+		}
+		return nil, err
+	}
+	if user.Email != token.Email {
+		return nil, ErrInvalidEmailToken
+	}
+
+	return user, nil
+}
+
+func (h *Handler) sendMail(message mail.Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	return h.Mailer.Send(ctx, message)
+}
+
+// emailLink builds a frontend link carrying a token
+func emailLink(path, token string) string {
+	return GetAppURL() + "/" + path + "?token=" + url.QueryEscape(token)
+}
+
+// describeDuration writes a link lifetime in words, such as "2 hours"
+func describeDuration(d time.Duration) string {
+	n, unit := int(d/time.Minute), "minute"
+	if d%time.Hour == 0 {
+		n, unit = int(d/time.Hour), "hour"
+	}
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
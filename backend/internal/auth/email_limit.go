@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/ratelimit"
+)
+
+// emailResendInterval is how long after sending a link another request for
+// the same kind of link is ignored. The link already sent still works.
+const emailResendInterval = 5 * time.Minute
+
+// emailLimiter throttles the requests that send email, per address and per
+// client IP, so they cannot be used to flood an inbox or use up the mail
+// provider's quota
+type emailLimiter struct {
+	addresses *ratelimit.Registry
+	ips       *ratelimit.Registry
+}
+
+// newEmailLimiter reads its limits from EMAIL_LIMIT_PER_ADDRESS, the emails
+// one address can be sent per hour (5 by default), and EMAIL_LIMIT_PER_IP,
+// the requests one client IP can make per hour (20 by default)
+func newEmailLimiter() *emailLimiter {
+	perAddress := envInt("EMAIL_LIMIT_PER_ADDRESS", 5)
+	perIP := envInt("EMAIL_LIMIT_PER_IP", 20)
+
+	return &emailLimiter{
+		addresses: ratelimit.NewRegistry(float64(perAddress)/time.Hour.Seconds(), perAddress),
+		ips:       ratelimit.NewRegistry(float64(perIP)/time.Hour.Seconds(), perIP),
+	}
+}
+
+// allow takes a request to email address from ip, reporting whether it is
+// within both limits
+func (l *emailLimiter) allow(address, ip string) bool {
+	return ratelimit.AllowAll(l.addresses.Get(strings.ToLower(address)), l.ips.Get(ip))
+}
@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envDuration reads a positive whole number of units, falling back when
+// the variable is unset or invalid
+func envDuration(name string, unit, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Printf("Invalid %s=%q, using default %s", name, value, fallback)
+		return fallback
+	}
+
+	return time.Duration(n) * unit
+}
+
+// envInt reads a positive integer, falling back when the variable is
+// unset or invalid
+func envInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Printf("Invalid %s=%q, using default %d", name, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+// envList reads a comma-separated list, skipping empty entries
+func envList(name string) []string {
+	values := make([]string, 0)
+	for _, value := range strings.Split(os.Getenv(name), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
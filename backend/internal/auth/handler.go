@@ -1,16 +1,71 @@
 package auth
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
+
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/db"
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/mail"
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/oidc"
 )
 
+// Handler serves the auth endpoints, storing accounts in Users and logins
+// in Sessions. Verification and password reset links are sent through
+// Mailer, and access tokens are signed with Keys.
+type Handler struct {
+	Users       db.UserRepository
+	Sessions    db.SessionRepository
+	EmailTokens db.EmailTokenRepository
+	Mailer      mail.Mailer
+	Keys        *KeySet
+
+	// OnSessionRevoked is called after a session is revoked, so anything
+	// still holding one of its tokens can be disconnected
+	OnSessionRevoked func(sessionID string)
+	// OnUserDeleted is called before an account is deleted to remove or
+	// anonymise data stored about it elsewhere. If it fails the account is
+	// kept.
+	OnUserDeleted func(ctx context.Context, userID string) error
+
+	// Rules are checked when account fields are set
+	Rules ValidationRules
+
+	// Providers are the external OpenID Connect providers users can log in
+	// with, by name
+	Providers map[string]*oidc.Provider
+
+	loginLimits *loginLimiter
+	emailLimits *emailLimiter
+	oidcLogins  *oidcLogins
+}
+
+func NewHandler(store *db.Store, mailer mail.Mailer, keys *KeySet) *Handler {
+	return &Handler{
+		Users:       store.Users,
+		Sessions:    store.Sessions,
+		EmailTokens: store.EmailTokens,
+		Mailer:      mailer,
+		Keys:        keys,
+		Rules:       LoadValidationRules(),
+		Providers:   loadOIDCProviders(),
+		loginLimits: newLoginLimiter(),
+		emailLimits: newEmailLimiter(),
+		oidcLogins:  newOIDCLogins(),
+	}
+}
+
 type RegisterRequest struct {
 	Username string `json:"username"`
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	// DisplayName is optional; the username is shown in game without one
+	DisplayName string `json:"displayName"`
 }
 
 type LoginRequest struct {
@@ -18,18 +73,27 @@ type LoginRequest struct {
 	Password string `json:"password"`
 }
 
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
 type AuthResponse struct {
 	Token     string    `json:"token"`
 	User      *User     `json:"user"`
 	ExpiresAt time.Time `json:"expiresAt"`
+	// RefreshToken is only included when a new one was issued
+	RefreshToken     string     `json:"refreshToken,omitempty"`
+	RefreshExpiresAt *time.Time `json:"refreshExpiresAt,omitempty"`
 }
 
 type ErrorResponse struct {
 	Error string `json:"error"`
+	// Fields explains which request fields were invalid, if any
+	Fields []FieldError `json:"fields,omitempty"`
 }
 
 // RegisterHandler handles user registration
-func RegisterHandler(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -42,13 +106,13 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate input
-	if req.Username == "" || req.Password == "" {
-		respondWithError(w, http.StatusBadRequest, "Username and password are required")
+	if err := h.Rules.ValidateRegistration(req); err != nil {
+		respondWithValidationError(w, err)
 		return
 	}
 
 	// Create user
-	user, err := CreateUser(req.Username, req.Email, req.Password)
+	user, err := h.CreateUser(req.Username, req.DisplayName, req.Email, req.Password)
 	if err != nil {
 		if err == ErrUserExists {
 			respondWithError(w, http.StatusConflict, "User already exists")
@@ -59,19 +123,23 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Generate token
-	token, err := GenerateToken(user.ID.Hex(), user.Username)
+	if user.Email != "" {
+		h.sendVerificationInBackground(user)
+	}
+
+	// Start a session
+	tokens, err := h.startSession(user)
 	if err != nil {
-		log.Printf("Error generating token: %v", err)
+		log.Printf("Error starting session: %v", err)
 		respondWithError(w, http.StatusInternalServerError, "Failed to generate token")
 		return
 	}
 
-	respondWithAuth(w, http.StatusCreated, token, user)
+	respondWithAuth(w, http.StatusCreated, tokens, user)
 }
 
 // LoginHandler handles user login
-func LoginHandler(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -89,84 +157,165 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ip := remoteIP(r)
+	if wait := h.loginLimits.begin(req.Username, ip); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		respondWithError(w, http.StatusTooManyRequests, "Too many failed login attempts, try again later")
+		return
+	}
+
 	// Authenticate user
-	user, err := AuthenticateUser(req.Username, req.Password)
+	user, err := h.AuthenticateUser(req.Username, req.Password)
 	if err != nil {
 		if err == ErrInvalidCredentials {
+			h.loginLimits.failed(req.Username, ip)
 			respondWithError(w, http.StatusUnauthorized, "Invalid credentials")
 			return
 		}
+		h.loginLimits.abandoned(req.Username, ip)
 		log.Printf("Error authenticating user: %v", err)
 		respondWithError(w, http.StatusInternalServerError, "Authentication failed")
 		return
 	}
+	h.loginLimits.succeeded(req.Username, ip)
 
-	// Generate token
-	token, err := GenerateToken(user.ID.Hex(), user.Username)
+	// Start a session
+	tokens, err := h.startSession(user)
 	if err != nil {
-		log.Printf("Error generating token: %v", err)
+		log.Printf("Error starting session: %v", err)
 		respondWithError(w, http.StatusInternalServerError, "Failed to generate token")
 		return
 	}
 
-	respondWithAuth(w, http.StatusOK, token, user)
+	respondWithAuth(w, http.StatusOK, tokens, user)
 }
 
 // VerifyTokenHandler verifies if a token is valid
-func VerifyTokenHandler(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) VerifyTokenHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	token := r.URL.Query().Get("token")
-	if token == "" {
-		// Try Authorization header
-		authHeader := r.Header.Get("Authorization")
-		if authHeader != "" && len(authHeader) > 7 && authHeader[:7] == "Bearer " {
-			token = authHeader[7:]
-		}
-	}
-
+	token := tokenFromRequest(r)
 	if token == "" {
 		respondWithError(w, http.StatusBadRequest, "Token is required")
 		return
 	}
 
-	claims, err := ValidateToken(token)
+	claims, err := h.ValidateToken(token)
 	if err != nil {
-		if err == ErrExpiredToken {
+		switch err {
+		case ErrExpiredToken:
 			respondWithError(w, http.StatusUnauthorized, "Token has expired")
-			return
+		case ErrRevokedToken:
+			respondWithError(w, http.StatusUnauthorized, "Token has been revoked")
+		default:
+			respondWithError(w, http.StatusUnauthorized, "Invalid token")
 		}
-		respondWithError(w, http.StatusUnauthorized, "Invalid token")
 		return
 	}
 
 	// Get user info
-	user, err := GetUserByID(claims.UserID)
+	user, err := h.GetUserByID(claims.UserID)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "User not found")
 		return
 	}
+	user.Password = ""
 
-	respondWithAuth(w, http.StatusOK, token, user)
+	respondWithAuth(w, http.StatusOK, &TokenPair{AccessToken: token, ExpiresAt: claims.ExpiresAt.Time}, user)
 }
 
-func respondWithError(w http.ResponseWriter, statusCode int, message string) {
+// RefreshHandler exchanges a refresh token for a new access token and a
+// new refresh token. Each refresh token can only be used once.
+func (h *Handler) RefreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		respondWithError(w, http.StatusBadRequest, "Refresh token is required")
+		return
+	}
+
+	tokens, user, err := h.refreshSession(req.RefreshToken)
+	if err != nil {
+		if err == ErrInvalidRefreshToken {
+			respondWithError(w, http.StatusUnauthorized, "Invalid refresh token")
+			return
+		}
+		log.Printf("Error refreshing session: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to refresh token")
+		return
+	}
+
+	respondWithAuth(w, http.StatusOK, tokens, user)
+}
+
+// LogoutHandler revokes the session of the access token, so neither it nor
+// the session's refresh token can be used again. Expired access tokens are
+// accepted.
+func (h *Handler) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := tokenFromRequest(r)
+	if token == "" {
+		respondWithError(w, http.StatusBadRequest, "Token is required")
+		return
+	}
+
+	sessionID, err := h.sessionFromToken(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token")
+		return
+	}
+
+	if err := h.revokeSession(sessionID); err != nil {
+		log.Printf("Error revoking session %s: %v", sessionID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to log out")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func respondWithJSON(w http.ResponseWriter, statusCode int, payload any) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(ErrorResponse{Error: message})
+	json.NewEncoder(w).Encode(payload)
 }
 
-func respondWithAuth(w http.ResponseWriter, statusCode int, token string, user *User) {
+func respondWithError(w http.ResponseWriter, statusCode int, message string) {
+	respondWithJSON(w, statusCode, ErrorResponse{Error: message})
+}
+
+func respondWithValidationError(w http.ResponseWriter, err error) {
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusBadRequest, ErrorResponse{Error: "Validation failed", Fields: validationErr.Fields})
+}
+
+func respondWithAuth(w http.ResponseWriter, statusCode int, tokens *TokenPair, user *User) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
 
-	expiresAt := time.Now().Add(24 * time.Hour)
-	json.NewEncoder(w).Encode(AuthResponse{
-		Token:     token,
-		User:      user,
-		ExpiresAt: expiresAt,
-	})
+	response := AuthResponse{
+		Token:        tokens.AccessToken,
+		User:         user,
+		ExpiresAt:    tokens.ExpiresAt,
+		RefreshToken: tokens.RefreshToken,
+	}
+	if tokens.RefreshToken != "" {
+		response.RefreshExpiresAt = &tokens.RefreshExpiresAt
+	}
+	json.NewEncoder(w).Encode(response)
 }
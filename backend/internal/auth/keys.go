@@ -0,0 +1,258 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// DefaultJWTSecret signs tokens when no secret or keys are configured. It is
+// published with the source, so it is refused in production.
+const DefaultJWTSecret = "minesweeper-secret-key-change-in-production"
+
+// minRSAKeyBits is the smallest RSA key accepted for signing tokens
+const minRSAKeyBits = 2048
+
+var ErrDefaultSecret = errors.New("refusing to sign tokens with the default JWT secret in production; set JWT_SECRET or JWT_KEY_FILES")
+
+// KeyConfig selects how access tokens are signed
+type KeyConfig struct {
+	// Secret is the HMAC secret used when there are no key files; it is
+	// ignored otherwise
+	Secret string
+	// KeyFiles are PEM files of RSA or Ed25519 keys. Each key's ID is its
+	// file name without the extension. Files holding only a public key are
+	// used to verify tokens signed by a retired key.
+	KeyFiles []string
+	// SigningKeyID picks the key new tokens are signed with, by default the
+	// first private key
+	SigningKeyID string
+	// Production refuses to start with the default secret
+	Production bool
+}
+
+// LoadKeyConfig reads the signing configuration from the environment:
+// JWT_SECRET, JWT_KEY_FILES (comma-separated), JWT_SIGNING_KEY_ID and
+// APP_ENV, which is "production" in production
+func LoadKeyConfig() KeyConfig {
+	return KeyConfig{
+		Secret:       os.Getenv("JWT_SECRET"),
+		KeyFiles:     envList("JWT_KEY_FILES"),
+		SigningKeyID: os.Getenv("JWT_SIGNING_KEY_ID"),
+		Production:   os.Getenv("APP_ENV") == "production",
+	}
+}
+
+// signingKey is one asymmetric key tokens can be verified with. private is
+// nil for keys that only verify.
+type signingKey struct {
+	id      string
+	method  jwt.SigningMethod
+	private crypto.Signer
+	public  crypto.PublicKey
+}
+
+// KeySet signs access tokens and verifies them. With key files, tokens are
+// signed with RS256 or EdDSA and carry the ID of their key, so keys can be
+// rotated: add the new key as the signing key and keep the old one, or just
+// its public half, until its tokens have expired. Without key files tokens
+// are signed with an HMAC secret.
+type KeySet struct {
+	secret  []byte
+	signing *signingKey
+	keys    map[string]*signingKey
+}
+
+// LoadKeys builds the key set from config, reading any key files
+func LoadKeys(config KeyConfig) (*KeySet, error) {
+	if len(config.KeyFiles) == 0 {
+		if config.Secret == "" || config.Secret == DefaultJWTSecret {
+			if config.Production {
+				return nil, ErrDefaultSecret
+			}
+			log.Println("Signing tokens with the default JWT secret, set JWT_SECRET or JWT_KEY_FILES before deploying")
+			config.Secret = DefaultJWTSecret
+		}
+		return NewHMACKeys([]byte(config.Secret)), nil
+	}
+
+	keys := &KeySet{keys: make(map[string]*signingKey)}
+	for _, path := range config.KeyFiles {
+		key, err := readSigningKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("loading JWT key %s: %w", path, err)
+		}
+		if _, ok := keys.keys[key.id]; ok {
+			return nil, fmt.Errorf("loading JWT key %s: key ID %q is used twice", path, key.id)
+		}
+		keys.keys[key.id] = key
+
+		if keys.signing == nil && config.SigningKeyID == "" && key.private != nil {
+			keys.signing = key
+		}
+	}
+
+	if config.SigningKeyID != "" {
+		keys.signing = keys.keys[config.SigningKeyID]
+		if keys.signing == nil {
+			return nil, fmt.Errorf("JWT_SIGNING_KEY_ID %q matches no key file", config.SigningKeyID)
+		}
+	}
+	if keys.signing == nil || keys.signing.private == nil {
+		return nil, errors.New("no JWT key file holds a private key to sign with")
+	}
+
+	log.Printf("Signing tokens with %s key %q, %d key(s) accepted", keys.signing.method.Alg(), keys.signing.id, len(keys.keys))
+	return keys, nil
+}
+
+// NewHMACKeys signs and verifies tokens with a shared secret
+func NewHMACKeys(secret []byte) *KeySet {
+	return &KeySet{secret: secret}
+}
+
+func (k *KeySet) sign(claims jwt.Claims) (string, error) {
+	if k.signing == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(k.secret)
+	}
+
+	token := jwt.NewWithClaims(k.signing.method, claims)
+	token.Header["kid"] = k.signing.id
+	return token.SignedString(k.signing.private)
+}
+
+// verificationKey returns the key a token must be signed with. The token's
+// algorithm has to match the key, so a public key can never be used as an
+// HMAC secret.
+func (k *KeySet) verificationKey(token *jwt.Token) (interface{}, error) {
+	if k.signing == nil {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, ErrInvalidToken
+		}
+		return k.secret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := k.keys[kid]
+	if !ok || token.Method.Alg() != key.method.Alg() {
+		return nil, ErrInvalidToken
+	}
+	return key.public, nil
+}
+
+func readSigningKey(path string) (*signingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	key := &signingKey{id: strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))}
+
+	var parsed any
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch parsed := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.private, key.public = parsed, &parsed.PublicKey
+	case ed25519.PrivateKey:
+		key.private, key.public = parsed, parsed.Public()
+	case *rsa.PublicKey, ed25519.PublicKey:
+		key.public = parsed
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, expected RSA or Ed25519", parsed)
+	}
+
+	switch public := key.public.(type) {
+	case *rsa.PublicKey:
+		if public.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("RSA key has %d bits, at least %d are required", public.N.BitLen(), minRSAKeyBits)
+		}
+		key.method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		key.method = jwt.SigningMethodEdDSA
+	}
+
+	return key, nil
+}
+
+// JSONWebKey is a public key in a JWKS document
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// N and E are set for RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Crv and X are set for Ed25519 keys
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKSResponse struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// JWKS returns the public keys tokens may be signed with. It is empty when
+// an HMAC secret is used, since that cannot be published.
+func (k *KeySet) JWKS() JWKSResponse {
+	response := JWKSResponse{Keys: make([]JSONWebKey, 0, len(k.keys))}
+	for _, key := range k.keys {
+		jwk := JSONWebKey{Kid: key.id, Use: "sig", Alg: key.method.Alg()}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		}
+		response.Keys = append(response.Keys, jwk)
+	}
+	slices.SortFunc(response.Keys, func(a, b JSONWebKey) int {
+		return strings.Compare(a.Kid, b.Kid)
+	})
+	return response
+}
+
+// JWKSHandler serves /.well-known/jwks.json, the public keys other services
+// can verify access tokens with
+func (h *Handler) JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	// Verifiers should fetch again soon after a key is added
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, http.StatusOK, h.Keys.JWKS())
+}
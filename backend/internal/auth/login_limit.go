@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/metrics"
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/ratelimit"
+)
+
+// loginLimiter slows down password guessing. Failed logins are counted per
+// username and per client IP, and either one can block further attempts,
+// first with exponentially growing delays and then with a lockout. Each IP
+// gets more attempts than a username so players sharing an address are not
+// locked out by each other.
+type loginLimiter struct {
+	usernames *ratelimit.Lockout
+	ips       *ratelimit.Lockout
+}
+
+// newLoginLimiter reads its limits from LOGIN_LOCKOUT_THRESHOLD, the
+// failures that lock a username (10 by default), and
+// LOGIN_LOCKOUT_MINUTES, how long the lockout lasts (15 by default)
+func newLoginLimiter() *loginLimiter {
+	threshold := envInt("LOGIN_LOCKOUT_THRESHOLD", 10)
+	lockDuration := envDuration("LOGIN_LOCKOUT_MINUTES", time.Minute, 15*time.Minute)
+
+	return &loginLimiter{
+		usernames: ratelimit.NewLockout(ratelimit.LockoutPolicy{
+			FreeAttempts: 3,
+			BaseDelay:    time.Second,
+			MaxDelay:     time.Minute,
+			LockAfter:    threshold,
+			LockDuration: lockDuration,
+			ResetAfter:   time.Hour,
+		}),
+		ips: ratelimit.NewLockout(ratelimit.LockoutPolicy{
+			FreeAttempts: threshold,
+			BaseDelay:    time.Second,
+			MaxDelay:     time.Minute,
+			LockAfter:    threshold * 5,
+			LockDuration: lockDuration,
+			ResetAfter:   time.Hour,
+		}),
+	}
+}
+
+// begin starts a login for username from ip, or returns how long it must
+// wait. A started login must end with failed, succeeded or abandoned.
+func (l *loginLimiter) begin(username, ip string) time.Duration {
+	if wait := l.usernames.Attempt(username); wait > 0 {
+		return wait
+	}
+	if wait := l.ips.Attempt(ip); wait > 0 {
+		l.usernames.Release(username)
+		return wait
+	}
+	return 0
+}
+
+// failed records a failed login and logs any lockout it causes
+func (l *loginLimiter) failed(username, ip string) {
+	metrics.FailedLogins.Add(1)
+
+	if failure := l.usernames.Fail(username); failure.Locked {
+		metrics.LoginLockouts.Add(1)
+		log.Printf("Locked logins for username %q after %d failed attempts, last from %s, until %s",
+			username, failure.Failures, ip, failure.BlockedUntil.Format(time.RFC3339))
+	}
+	if failure := l.ips.Fail(ip); failure.Locked {
+		metrics.LoginLockouts.Add(1)
+		log.Printf("Locked logins from %s after %d failed attempts, last for username %q, until %s",
+			ip, failure.Failures, username, failure.BlockedUntil.Format(time.RFC3339))
+	}
+}
+
+// succeeded ends a login and clears the failures of its username. The IP's
+// failures are kept, so logging in to one account does not allow more
+// guesses at others.
+func (l *loginLimiter) succeeded(username, ip string) {
+	l.forget(username)
+	l.abandoned(username, ip)
+}
+
+// abandoned ends a login that could not be checked without counting it
+func (l *loginLimiter) abandoned(username, ip string) {
+	l.usernames.Release(username)
+	l.ips.Release(ip)
+}
+
+// forget clears the failures of a username, such as after its password is
+// reset
+func (l *loginLimiter) forget(username string) {
+	l.usernames.Reset(username)
+}
+
+// remoteIP returns the client address without its port
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -9,25 +9,19 @@ type contextKey string
 
 const UserIDKey contextKey = "userID"
 const UsernameKey contextKey = "username"
+const SessionIDKey contextKey = "sessionID"
+const RoleKey contextKey = "role"
 
 // AuthMiddleware validates JWT token and adds user info to request context
-func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+func (h *Handler) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		token := r.URL.Query().Get("token")
-		if token == "" {
-			// Try Authorization header
-			authHeader := r.Header.Get("Authorization")
-			if authHeader != "" && len(authHeader) > 7 && authHeader[:7] == "Bearer " {
-				token = authHeader[7:]
-			}
-		}
-
+		token := tokenFromRequest(r)
 		if token == "" {
 			http.Error(w, "Authentication required", http.StatusUnauthorized)
 			return
 		}
 
-		claims, err := ValidateToken(token)
+		claims, err := h.ValidateToken(token)
 		if err != nil {
 			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
 			return
@@ -36,11 +30,65 @@ func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		// Add user info to context
 		ctx := context.WithValue(r.Context(), UserIDKey, claims.UserID)
 		ctx = context.WithValue(ctx, UsernameKey, claims.Username)
+		ctx = context.WithValue(ctx, SessionIDKey, claims.SessionID)
+		ctx = context.WithValue(ctx, RoleKey, claims.Role)
+
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// RequireRole is AuthMiddleware for routes that need at least role. Callers
+// with a lesser role are refused with 403 Forbidden.
+func (h *Handler) RequireRole(role Role, next http.HandlerFunc) http.HandlerFunc {
+	return h.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if !HasRole(r.Context(), role) {
+			http.Error(w, "Insufficient permissions", http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	})
+}
+
+// OptionalAuthMiddleware adds user info to the request context when a valid
+// token is present, and otherwise lets the request through anonymously
+func (h *Handler) OptionalAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := tokenFromRequest(r)
+		if token == "" {
+			next(w, r)
+			return
+		}
+
+		claims, err := h.ValidateToken(token)
+		if err != nil {
+			next(w, r)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), UserIDKey, claims.UserID)
+		ctx = context.WithValue(ctx, UsernameKey, claims.Username)
+		ctx = context.WithValue(ctx, SessionIDKey, claims.SessionID)
+		ctx = context.WithValue(ctx, RoleKey, claims.Role)
 
 		next(w, r.WithContext(ctx))
 	}
 }
 
+// tokenFromRequest reads the token from the query string or the
+// Authorization header
+func tokenFromRequest(r *http.Request) string {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		// Try Authorization header
+		authHeader := r.Header.Get("Authorization")
+		if authHeader != "" && len(authHeader) > 7 && authHeader[:7] == "Bearer " {
+			token = authHeader[7:]
+		}
+	}
+	return token
+}
+
 // GetUserIDFromContext extracts user ID from request context
 func GetUserIDFromContext(ctx context.Context) (string, bool) {
 	userID, ok := ctx.Value(UserIDKey).(string)
@@ -52,3 +100,21 @@ func GetUsernameFromContext(ctx context.Context) (string, bool) {
 	username, ok := ctx.Value(UsernameKey).(string)
 	return username, ok
 }
+
+// GetSessionIDFromContext extracts the login session from request context
+func GetSessionIDFromContext(ctx context.Context) (string, bool) {
+	sessionID, ok := ctx.Value(SessionIDKey).(string)
+	return sessionID, ok
+}
+
+// GetRoleFromContext extracts the caller's role from request context
+func GetRoleFromContext(ctx context.Context) (Role, bool) {
+	role, ok := ctx.Value(RoleKey).(Role)
+	return role, ok
+}
+
+// HasRole reports whether the caller is logged in with at least role
+func HasRole(ctx context.Context, role Role) bool {
+	callerRole, ok := GetRoleFromContext(ctx)
+	return ok && callerRole.Includes(role)
+}
@@ -0,0 +1,463 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/db"
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/oidc"
+	"github.com/gameoflife0880/web_minesweeper/backend/pkg"
+)
+
+var ErrIdentityLinked = errors.New("identity is linked to another account")
+
+const (
+	// oidcLoginTTL is how long a user has to finish logging in at the
+	// provider
+	oidcLoginTTL = 10 * time.Minute
+	// maxPendingOIDCLogins bounds the logins waiting for a callback, since
+	// anyone can start one
+	maxPendingOIDCLogins = 10000
+	// oidcStateCookie holds the hash of the state of the login the browser
+	// started, so a state started elsewhere cannot be finished in it
+	oidcStateCookie = "oidc_state"
+	oidcCookiePath  = "/api/auth/oidc/"
+)
+
+type OIDCProviderResponse struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type OIDCStartResponse struct {
+	AuthorizationURL string `json:"authorizationURL"`
+	// State should be kept by the client and compared with the state the
+	// provider redirects back with before calling the callback endpoint
+	State string `json:"state"`
+}
+
+type OIDCCallbackRequest struct {
+	Code  string `json:"code"`
+	State string `json:"state"`
+}
+
+// pendingOIDCLogin is a login started with a provider that has not come
+// back yet. The verifier never leaves the server.
+type pendingOIDCLogin struct {
+	provider string
+	verifier string
+	nonce    string
+	// linkUserID is set when a logged in user is linking the identity to
+	// their account instead of logging in
+	linkUserID string
+	expiresAt  time.Time
+}
+
+// oidcLogins holds pending logins by state
+type oidcLogins struct {
+	mu      sync.Mutex
+	pending map[string]pendingOIDCLogin
+}
+
+func newOIDCLogins() *oidcLogins {
+	return &oidcLogins{pending: make(map[string]pendingOIDCLogin)}
+}
+
+func (l *oidcLogins) add(state string, login pendingOIDCLogin) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if len(l.pending) >= maxPendingOIDCLogins {
+		for key, pending := range l.pending {
+			if now.After(pending.expiresAt) {
+				delete(l.pending, key)
+			}
+		}
+		if len(l.pending) >= maxPendingOIDCLogins {
+			return false
+		}
+	}
+
+	l.pending[state] = login
+	return true
+}
+
+// take removes and returns a pending login, so each state is used once
+func (l *oidcLogins) take(state string) (pendingOIDCLogin, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	login, ok := l.pending[state]
+	delete(l.pending, state)
+	if !ok || time.Now().After(login.expiresAt) {
+		return pendingOIDCLogin{}, false
+	}
+	return login, true
+}
+
+// loadOIDCProviders sets up the providers configured in the environment,
+// which send users back to APP_URL/oidc/callback unless OIDC_REDIRECT_URL
+// says otherwise
+func loadOIDCProviders() map[string]*oidc.Provider {
+	providers := make(map[string]*oidc.Provider)
+	for _, config := range oidc.LoadConfigs(GetAppURL() + "/oidc/callback") {
+		providers[config.Name] = oidc.NewProvider(config)
+		log.Printf("Enabled login with %s (%s)", config.DisplayName, config.Issuer)
+	}
+	return providers
+}
+
+// OIDCProvidersHandler lists the external providers users can log in with
+func (h *Handler) OIDCProvidersHandler(w http.ResponseWriter, r *http.Request) {
+	providers := make([]OIDCProviderResponse, 0, len(h.Providers))
+	for _, provider := range h.Providers {
+		providers = append(providers, OIDCProviderResponse{Name: provider.Name, DisplayName: provider.DisplayName})
+	}
+	// Map order is random, keep the list stable for clients
+	slices.SortFunc(providers, func(a, b OIDCProviderResponse) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	respondWithJSON(w, http.StatusOK, providers)
+}
+
+// OIDCStartHandler begins a login with the provider in the path and returns
+// the URL to send the user to. If the caller is logged in, finishing the
+// flow links the provider's identity to their account instead. It expects
+// to be wrapped in OptionalAuthMiddleware.
+func (h *Handler) OIDCStartHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := h.Providers[r.PathValue("provider")]
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Unknown login provider")
+		return
+	}
+
+	userID, _ := GetUserIDFromContext(r.Context())
+	response, err := h.StartOIDCLogin(r.Context(), provider, userID)
+	if err != nil {
+		log.Printf("Error starting login with %s: %v", provider.Name, err)
+		respondWithError(w, http.StatusBadGateway, "Failed to start login with provider")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    hashToken(response.State),
+		Path:     oidcCookiePath,
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(GetAppURL(), "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+// OIDCCallbackHandler finishes a login with the code and state the provider
+// redirected back with. The state must be the one whose cookie
+// OIDCStartHandler set, which keeps an attacker from having a victim's
+// browser finish the attacker's login. A login responds like LoginHandler,
+// with 201 if a new account was created, and a link responds with the
+// updated user.
+func (h *Handler) OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := h.Providers[r.PathValue("provider")]
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Unknown login provider")
+		return
+	}
+
+	var req OIDCCallbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" || req.State == "" {
+		respondWithError(w, http.StatusBadRequest, "Code and state are required")
+		return
+	}
+
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(hashToken(req.State))) != 1 {
+		respondWithError(w, http.StatusBadRequest, "Invalid or expired login, please start again")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: oidcCookiePath, MaxAge: -1})
+
+	login, ok := h.oidcLogins.take(req.State)
+	if !ok || login.provider != provider.Name {
+		respondWithError(w, http.StatusBadRequest, "Invalid or expired login, please start again")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+	defer cancel()
+
+	claims, err := provider.Exchange(ctx, req.Code, login.verifier, login.nonce)
+	if err != nil {
+		var tokenErr *oidc.TokenError
+		if errors.As(err, &tokenErr) || errors.Is(err, oidc.ErrInvalidIDToken) {
+			log.Printf("Rejected login with %s: %v", provider.Name, err)
+			respondWithError(w, http.StatusUnauthorized, "Login with provider failed")
+			return
+		}
+		log.Printf("Error finishing login with %s: %v", provider.Name, err)
+		respondWithError(w, http.StatusBadGateway, "Failed to reach login provider")
+		return
+	}
+
+	if login.linkUserID != "" {
+		user, err := h.LinkIdentity(login.linkUserID, provider.Name, claims)
+		if err != nil {
+			if errors.Is(err, ErrIdentityLinked) {
+				respondWithError(w, http.StatusConflict, "This login is already linked to another account")
+				return
+			}
+			respondWithUserError(w, login.linkUserID, err)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, user)
+		return
+	}
+
+	user, created, err := h.LoginWithIdentity(provider.Name, claims)
+	if err != nil {
+		log.Printf("Error logging in with %s: %v", provider.Name, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to log in")
+		return
+	}
+
+	tokens, err := h.startSession(user)
+	if err != nil {
+		log.Printf("Error starting session: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate token")
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	respondWithAuth(w, status, tokens, user)
+}
+
+// StartOIDCLogin creates the state, nonce and PKCE verifier of a new login
+// with provider and returns where to send the user. linkUserID is the
+// logged in user to link the identity to, if any.
+func (h *Handler) StartOIDCLogin(ctx context.Context, provider *oidc.Provider, linkUserID string) (*OIDCStartResponse, error) {
+	state, err := oidc.NewState()
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := oidc.NewState()
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := oidc.NewVerifier()
+	if err != nil {
+		return nil, err
+	}
+
+	authorizationURL, err := provider.AuthCodeURL(ctx, state, nonce, verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	added := h.oidcLogins.add(state, pendingOIDCLogin{
+		provider:   provider.Name,
+		verifier:   verifier,
+		nonce:      nonce,
+		linkUserID: linkUserID,
+		expiresAt:  time.Now().Add(oidcLoginTTL),
+	})
+	if !added {
+		return nil, errors.New("too many pending logins")
+	}
+
+	return &OIDCStartResponse{AuthorizationURL: authorizationURL, State: state}, nil
+}
+
+// LoginWithIdentity returns the account an external identity is linked to.
+// An identity seen for the first time is linked to the account with the
+// same email if both the provider and this server verified it, and
+// otherwise gets a new account. created reports whether one was made.
+func (h *Handler) LoginWithIdentity(provider string, claims *oidc.Claims) (user *User, created bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err = h.Users.GetByIdentity(ctx, provider, claims.Subject)
+	if err == nil {
+		user.Password = ""
+		return user, false, nil
+	}
+	if !errors.Is(err, ErrUserNotFound) {
+		return nil, false, err
+	}
+
+	email := claims.Email
+	if email != "" {
+		existing, err := h.Users.GetByEmail(ctx, email)
+		switch {
+		case err == nil && claims.EmailVerified && existing.EmailVerified:
+			return h.addIdentity(ctx, existing, provider, claims)
+		case err == nil:
+			// Without both sides verifying the email there is no proof the
+			// accounts belong to the same person, so keep them apart
+			email = ""
+		case !errors.Is(err, ErrUserNotFound):
+			return nil, false, err
+		}
+	}
+
+	user, err = h.createIdentityUser(ctx, provider, claims, email)
+	if errors.Is(err, ErrIdentityLinked) {
+		// A login with the same identity made the account first
+		user, err = h.Users.GetByIdentity(ctx, provider, claims.Subject)
+		if err != nil {
+			return nil, false, err
+		}
+		user.Password = ""
+		return user, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return user, true, nil
+}
+
+// LinkIdentity adds an external identity to a logged in user's account
+func (h *Handler) LinkIdentity(userID, provider string, claims *oidc.Claims) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	linked, err := h.Users.GetByIdentity(ctx, provider, claims.Subject)
+	if err == nil {
+		if linked.ID.Hex() != userID {
+			return nil, ErrIdentityLinked
+		}
+		linked.Password = ""
+		return linked, nil
+	}
+	if !errors.Is(err, ErrUserNotFound) {
+		return nil, err
+	}
+
+	user, err := h.Users.GetByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	user, _, err = h.addIdentity(ctx, user, provider, claims)
+	return user, err
+}
+
+func (h *Handler) addIdentity(ctx context.Context, user *User, provider string, claims *oidc.Claims) (*User, bool, error) {
+	now := time.Now()
+	user.Identities = append(user.Identities, db.Identity{
+		Provider: provider,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+		LinkedAt: now,
+	})
+	user.UpdatedAt = now
+
+	if err := h.Users.Update(ctx, user); err != nil {
+		if errors.Is(err, db.ErrIdentityExists) {
+			return nil, false, ErrIdentityLinked
+		}
+		return nil, false, err
+	}
+	log.Printf("Linked %s identity to user %s", provider, user.ID.Hex())
+
+	// Don't return password
+	user.Password = ""
+	return user, false, nil
+}
+
+// createIdentityUser makes an account for a new external identity. It has
+// no password, and its username is taken from the provider's claims,
+// adjusted to the validation rules and made unique.
+func (h *Handler) createIdentityUser(ctx context.Context, provider string, claims *oidc.Claims, email string) (*User, error) {
+	displayName := ""
+	if claims.Name != "" && pkg.ValidateNickname(claims.Name) == nil && !h.Rules.IsReserved(claims.Name) {
+		displayName = claims.Name
+	}
+
+	base := h.identityUsername(claims)
+	now := time.Now()
+	for attempt := 0; attempt < 10; attempt++ {
+		username := base
+		if attempt > 0 || h.Rules.IsReserved(base) {
+			suffix := strconv.Itoa(rand.IntN(10000))
+			username = base[:min(len(base), h.Rules.UsernameMaxLength-len(suffix))] + suffix
+		}
+
+		user := &User{
+			ID:            primitive.NewObjectID(),
+			Username:      username,
+			DisplayName:   displayName,
+			Email:         email,
+			EmailVerified: email != "" && claims.EmailVerified,
+			Role:          RolePlayer,
+			Identities: []db.Identity{{
+				Provider: provider,
+				Subject:  claims.Subject,
+				Email:    claims.Email,
+				LinkedAt: now,
+			}},
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+
+		err := h.Users.Create(ctx, user)
+		if err == nil {
+			log.Printf("Created user %s for %s identity", user.ID.Hex(), provider)
+			return user, nil
+		}
+		// Another login with the same identity got there first
+		if errors.Is(err, db.ErrIdentityExists) {
+			return nil, ErrIdentityLinked
+		}
+		if !errors.Is(err, ErrUserExists) {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("no free username for %q", base)
+}
+
+// identityUsername picks a username from the provider's claims, keeping
+// only the characters usernames allow
+func (h *Handler) identityUsername(claims *oidc.Claims) string {
+	candidates := []string{claims.PreferredUsername, claims.Email, claims.Name}
+	if at := strings.Index(claims.Email, "@"); at >= 0 {
+		candidates[1] = claims.Email[:at]
+	}
+
+	for _, candidate := range candidates {
+		var b strings.Builder
+		for _, char := range candidate {
+			if pkg.ValidNameCharset(string(char)) {
+				b.WriteRune(char)
+			} else if char == ' ' || char == '.' {
+				b.WriteRune('_')
+			}
+		}
+
+		username := b.String()
+		if len(username) > h.Rules.UsernameMaxLength {
+			username = username[:h.Rules.UsernameMaxLength]
+		}
+		if len(username) >= h.Rules.UsernameMinLength {
+			return username
+		}
+	}
+	return "player"
+}
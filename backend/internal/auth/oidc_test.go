@@ -0,0 +1,297 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/db"
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/oidc"
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/oidc/oidctest"
+)
+
+func newOIDCTestHandler(t *testing.T) (*Handler, *oidctest.Issuer) {
+	t.Helper()
+
+	issuer := oidctest.NewIssuer(t, "minesweeper")
+	h := NewHandler(db.NewMemoryStore(), nil, NewHMACKeys([]byte("test-secret")))
+	h.Providers = map[string]*oidc.Provider{
+		"test": oidc.NewProvider(oidc.Config{
+			Name:        "test",
+			Issuer:      issuer.URL(),
+			ClientID:    issuer.ClientID,
+			Scopes:      oidc.DefaultScopes,
+			RedirectURL: "http://localhost/oidc/callback",
+		}),
+	}
+	return h, issuer
+}
+
+// startOIDCLogin starts a login, as the user with accessToken if set, and
+// returns the start response and the state cookie set with it
+func startOIDCLogin(t *testing.T, h *Handler, accessToken string) (*OIDCStartResponse, *http.Cookie) {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/auth/oidc/test/start", nil)
+	r.SetPathValue("provider", "test")
+	if accessToken != "" {
+		r.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	w := httptest.NewRecorder()
+	h.OptionalAuthMiddleware(h.OIDCStartHandler)(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("start status = %d, body %s", w.Code, w.Body)
+	}
+
+	var response OIDCStartResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("decoding start response: %v", err)
+	}
+
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == oidcStateCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("start set state cookie %+v, want an HttpOnly SameSite=Lax cookie", cookie)
+	}
+	return &response, cookie
+}
+
+func finishOIDCLogin(h *Handler, code, state string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(OIDCCallbackRequest{Code: code, State: state})
+	r := httptest.NewRequest(http.MethodPost, "/api/auth/oidc/test/callback", strings.NewReader(string(body)))
+	r.SetPathValue("provider", "test")
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	h.OIDCCallbackHandler(w, r)
+	return w
+}
+
+func TestOIDCCallbackState(t *testing.T) {
+	identity := oidctest.Identity{Subject: "alice", PreferredUsername: "alice"}
+
+	tests := []struct {
+		name string
+		// cookie picks the cookie sent with the callback from the one set
+		// for this login and one set for a login started elsewhere
+		cookie     func(own, other *http.Cookie) *http.Cookie
+		wantStatus int
+	}{
+		{
+			name:       "cookie of this login",
+			cookie:     func(own, other *http.Cookie) *http.Cookie { return own },
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "no cookie",
+			cookie:     func(own, other *http.Cookie) *http.Cookie { return nil },
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "cookie of another login",
+			cookie:     func(own, other *http.Cookie) *http.Cookie { return other },
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, issuer := newOIDCTestHandler(t)
+
+			start, own := startOIDCLogin(t, h, "")
+			_, other := startOIDCLogin(t, h, "")
+			code, state := issuer.Authorize(t, start.AuthorizationURL, identity)
+
+			w := finishOIDCLogin(h, code, state, tt.cookie(own, other))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("callback status = %d, want %d, body %s", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackRejectsInvalidTokens(t *testing.T) {
+	tests := []struct {
+		name     string
+		identity oidctest.Identity
+		// reuse redeems the code a second time
+		reuse bool
+	}{
+		{name: "nonce mismatch", identity: oidctest.Identity{Subject: "alice", Nonce: "replayed"}},
+		{name: "code reused", identity: oidctest.Identity{Subject: "alice"}, reuse: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, issuer := newOIDCTestHandler(t)
+
+			start, cookie := startOIDCLogin(t, h, "")
+			code, state := issuer.Authorize(t, start.AuthorizationURL, tt.identity)
+			w := finishOIDCLogin(h, code, state, cookie)
+
+			if tt.reuse {
+				if w.Code != http.StatusCreated {
+					t.Fatalf("first callback status = %d, body %s", w.Code, w.Body)
+				}
+				// A new login with the old code fails PKCE and the code
+				// was already redeemed
+				start, cookie = startOIDCLogin(t, h, "")
+				_, state = issuer.Authorize(t, start.AuthorizationURL, tt.identity)
+				w = finishOIDCLogin(h, code, state, cookie)
+			}
+
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("callback status = %d, want %d, body %s", w.Code, http.StatusUnauthorized, w.Body)
+			}
+		})
+	}
+}
+
+func TestOIDCEmailAutoLink(t *testing.T) {
+	tests := []struct {
+		name             string
+		accountVerified  bool
+		providerVerified bool
+		wantLinked       bool
+	}{
+		{name: "both verified", accountVerified: true, providerVerified: true, wantLinked: true},
+		{name: "provider unverified", accountVerified: true, providerVerified: false},
+		{name: "account unverified", accountVerified: false, providerVerified: true},
+		{name: "neither verified"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, issuer := newOIDCTestHandler(t)
+
+			existing, err := h.CreateUser("bob", "", "bob@example.com", "correct-horse-battery")
+			if err != nil {
+				t.Fatalf("CreateUser: %v", err)
+			}
+			if tt.accountVerified {
+				existing.EmailVerified = true
+				if err := h.Users.Update(context.Background(), existing); err != nil {
+					t.Fatalf("verifying email: %v", err)
+				}
+			}
+
+			start, cookie := startOIDCLogin(t, h, "")
+			code, state := issuer.Authorize(t, start.AuthorizationURL, oidctest.Identity{
+				Subject:           "bob-at-provider",
+				Email:             "bob@example.com",
+				EmailVerified:     tt.providerVerified,
+				PreferredUsername: "bob",
+			})
+			w := finishOIDCLogin(h, code, state, cookie)
+
+			var response AuthResponse
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatalf("decoding callback response: %v", err)
+			}
+
+			if tt.wantLinked {
+				if w.Code != http.StatusOK || response.User.ID != existing.ID {
+					t.Fatalf("callback status = %d, user %s, want the existing account %s", w.Code, response.User.ID.Hex(), existing.ID.Hex())
+				}
+				return
+			}
+
+			if w.Code != http.StatusCreated || response.User.ID == existing.ID {
+				t.Fatalf("callback status = %d, user %s, want a new account", w.Code, response.User.ID.Hex())
+			}
+			// The email stays with the account that already had it
+			if response.User.Email != "" {
+				t.Errorf("new account email = %q, want none", response.User.Email)
+			}
+		})
+	}
+}
+
+func TestOIDCLinkFlow(t *testing.T) {
+	h, issuer := newOIDCTestHandler(t)
+	identity := oidctest.Identity{Subject: "carol-at-provider", PreferredUsername: "carol"}
+
+	carol, err := h.CreateUser("carol", "", "", "correct-horse-battery")
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	tokens, err := h.startSession(carol)
+	if err != nil {
+		t.Fatalf("startSession: %v", err)
+	}
+
+	start, cookie := startOIDCLogin(t, h, tokens.AccessToken)
+	code, state := issuer.Authorize(t, start.AuthorizationURL, identity)
+	if w := finishOIDCLogin(h, code, state, cookie); w.Code != http.StatusOK {
+		t.Fatalf("link status = %d, body %s", w.Code, w.Body)
+	}
+
+	// Logging in with the identity now reaches the linked account
+	start, cookie = startOIDCLogin(t, h, "")
+	code, state = issuer.Authorize(t, start.AuthorizationURL, identity)
+	w := finishOIDCLogin(h, code, state, cookie)
+
+	var response AuthResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("decoding callback response: %v", err)
+	}
+	if w.Code != http.StatusOK || response.User.ID != carol.ID {
+		t.Fatalf("login status = %d, user %s, want %s", w.Code, response.User.ID.Hex(), carol.ID.Hex())
+	}
+}
+
+func TestOIDCIdentityConflicts(t *testing.T) {
+	tests := []struct {
+		name    string
+		subject string
+		// wantLinked reports whether the identity already belongs to dave
+		wantLinked bool
+	}{
+		{name: "identity of another user", subject: "dave-at-test", wantLinked: true},
+		// dave has both this provider and this subject, but never together
+		{name: "provider and subject of different identities", subject: "dave-at-other"},
+		{name: "unrelated identity", subject: "erin-at-test"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := newOIDCTestHandler(t)
+
+			dave, err := h.CreateUser("dave", "", "", "correct-horse-battery")
+			if err != nil {
+				t.Fatalf("CreateUser: %v", err)
+			}
+			if _, err := h.LinkIdentity(dave.ID.Hex(), "test", &oidc.Claims{Subject: "dave-at-test"}); err != nil {
+				t.Fatalf("linking test identity: %v", err)
+			}
+			if _, err := h.LinkIdentity(dave.ID.Hex(), "other", &oidc.Claims{Subject: "dave-at-other"}); err != nil {
+				t.Fatalf("linking other identity: %v", err)
+			}
+
+			erin, err := h.CreateUser("erin", "", "", "correct-horse-battery")
+			if err != nil {
+				t.Fatalf("CreateUser: %v", err)
+			}
+			_, err = h.LinkIdentity(erin.ID.Hex(), "test", &oidc.Claims{Subject: tt.subject})
+			if tt.wantLinked && !errors.Is(err, ErrIdentityLinked) || !tt.wantLinked && err != nil {
+				t.Fatalf("LinkIdentity error = %v, want linked %t", err, tt.wantLinked)
+			}
+
+			// The identity now belongs to someone, so a new account for it
+			// fails as a linked identity rather than a taken username
+			claims := &oidc.Claims{Subject: tt.subject, PreferredUsername: "frank"}
+			if _, err := h.createIdentityUser(context.Background(), "test", claims, ""); !errors.Is(err, ErrIdentityLinked) {
+				t.Errorf("createIdentityUser error = %v, want %v", err, ErrIdentityLinked)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrWrongPassword = errors.New("current password is incorrect")
+
+// UpdateProfileRequest changes the fields that are set and leaves the rest.
+// An empty display name clears it.
+type UpdateProfileRequest struct {
+	DisplayName *string `json:"displayName"`
+	Email       *string `json:"email"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+// MeHandler returns the caller's account. It expects to be wrapped in
+// AuthMiddleware.
+func (h *Handler) MeHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := GetUserIDFromContext(r.Context())
+
+	user, err := h.GetUserByID(userID)
+	if err != nil {
+		respondWithUserError(w, userID, err)
+		return
+	}
+	user.Password = ""
+
+	respondWithJSON(w, http.StatusOK, user)
+}
+
+// UpdateMeHandler changes the caller's display name or email
+func (h *Handler) UpdateMeHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := GetUserIDFromContext(r.Context())
+
+	var req UpdateProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if err := h.Rules.ValidateProfile(req); err != nil {
+		respondWithValidationError(w, err)
+		return
+	}
+
+	user, err := h.UpdateProfile(userID, req)
+	if err != nil {
+		if errors.Is(err, ErrUserExists) {
+			respondWithError(w, http.StatusConflict, "Email is already in use")
+			return
+		}
+		respondWithUserError(w, userID, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, user)
+}
+
+// ChangePasswordHandler sets a new password for the caller after checking
+// their current one. Accounts created through a login provider have no
+// password yet and can set one without.
+func (h *Handler) ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := GetUserIDFromContext(r.Context())
+
+	var req ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.NewPassword == "" {
+		respondWithError(w, http.StatusBadRequest, "New password is required")
+		return
+	}
+
+	if err := h.ChangePassword(userID, req.CurrentPassword, req.NewPassword); err != nil {
+		var validationErr *ValidationError
+		if errors.As(err, &validationErr) {
+			respondWithValidationError(w, err)
+			return
+		}
+		if errors.Is(err, ErrWrongPassword) {
+			respondWithError(w, http.StatusForbidden, "Current password is incorrect")
+			return
+		}
+		respondWithUserError(w, userID, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteMeHandler deletes the caller's account, anonymising their match
+// history and ending all of their sessions
+func (h *Handler) DeleteMeHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := GetUserIDFromContext(r.Context())
+
+	if err := h.DeleteUser(userID); err != nil {
+		respondWithUserError(w, userID, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UpdateProfile applies a profile change and returns the updated user. A
+// new email has to be verified again, so a verification email is sent to
+// it.
+func (h *Handler) UpdateProfile(userID string, req UpdateProfileRequest) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := h.Users.GetByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.DisplayName != nil {
+		user.DisplayName = *req.DisplayName
+	}
+	emailChanged := req.Email != nil && *req.Email != user.Email
+	if emailChanged {
+		user.Email = *req.Email
+		user.EmailVerified = false
+	}
+	user.UpdatedAt = time.Now()
+
+	if err := h.Users.Update(ctx, user); err != nil {
+		return nil, err
+	}
+
+	if emailChanged && user.Email != "" {
+		h.sendVerificationInBackground(user)
+	}
+
+	// Don't return password
+	user.Password = ""
+	return user, nil
+}
+
+// ChangePassword replaces a user's password if currentPassword matches, or
+// sets one if the user has none yet, returning a *ValidationError if the new password breaks the rules
+func (h *Handler) ChangePassword(userID, currentPassword, newPassword string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := h.Users.GetByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	if user.Password != "" {
+		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(currentPassword)); err != nil {
+			return ErrWrongPassword
+		}
+	}
+	if err := h.Rules.ValidatePassword("newPassword", newPassword, user.Username); err != nil {
+		return err
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	user.Password = string(hashedPassword)
+	user.UpdatedAt = time.Now()
+
+	return h.Users.Update(ctx, user)
+}
+
+// DeleteUser removes an account. OnUserDeleted runs first, so the account
+// is kept if its history could not be anonymised, then every session of
+// the user is revoked.
+func (h *Handler) DeleteUser(userID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if _, err := h.Users.GetByID(ctx, userID); err != nil {
+		return err
+	}
+
+	if h.OnUserDeleted != nil {
+		if err := h.OnUserDeleted(ctx, userID); err != nil {
+			return err
+		}
+	}
+
+	if err := h.Users.Delete(ctx, userID); err != nil {
+		return err
+	}
+
+	return h.revokeUserSessions(ctx, userID)
+}
+
+// respondWithUserError reports an error loading or saving the caller's
+// account
+func respondWithUserError(w http.ResponseWriter, userID string, err error) {
+	if errors.Is(err, ErrUserNotFound) {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	log.Printf("Error updating user %s: %v", userID, err)
+	respondWithError(w, http.StatusInternalServerError, "Failed to update account")
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+var (
+	ErrInvalidRole = errors.New("invalid role")
+	ErrOwnRole     = errors.New("cannot change your own role")
+)
+
+type SetRoleRequest struct {
+	Role Role `json:"role"`
+}
+
+// SetRoleHandler serves PUT /api/users/{id}/role, changing another user's
+// role. It expects to be wrapped in RequireRole(RoleAdmin).
+func (h *Handler) SetRoleHandler(w http.ResponseWriter, r *http.Request) {
+	actorID, _ := GetUserIDFromContext(r.Context())
+	userID := r.PathValue("id")
+
+	var req SetRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	user, err := h.SetRole(actorID, userID, req.Role)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidRole):
+			respondWithError(w, http.StatusBadRequest, "Role must be player, moderator or admin")
+		case errors.Is(err, ErrOwnRole):
+			// Keeps the last admin from locking everyone out by accident
+			respondWithError(w, http.StatusForbidden, "You cannot change your own role")
+		default:
+			respondWithUserError(w, userID, err)
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, user)
+}
+
+// SetRole gives a user a new role on behalf of actorID and revokes the
+// user's sessions, so tokens issued with the old role stop working
+func (h *Handler) SetRole(actorID, userID string, role Role) (*User, error) {
+	if !role.Valid() {
+		return nil, ErrInvalidRole
+	}
+	if actorID == userID {
+		return nil, ErrOwnRole
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, err := h.Users.GetByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	previous := user.Role
+	if previous == role || (previous == "" && role == RolePlayer) {
+		user.Password = ""
+		return user, nil
+	}
+
+	user.Role = role
+	user.UpdatedAt = time.Now()
+	if err := h.Users.Update(ctx, user); err != nil {
+		return nil, err
+	}
+	log.Printf("User %s changed the role of user %s from %q to %q", actorID, userID, previous, role)
+
+	if err := h.revokeUserSessions(ctx, userID); err != nil {
+		log.Printf("Error revoking sessions of user %s after a role change: %v", userID, err)
+	}
+
+	// Don't return password
+	user.Password = ""
+	return user, nil
+}
@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/db"
+)
+
+var ErrInvalidRefreshToken = errors.New("invalid refresh token")
+
+// TokenPair is what a client receives when it logs in or refreshes
+type TokenPair struct {
+	AccessToken      string
+	ExpiresAt        time.Time
+	RefreshToken     string
+	RefreshExpiresAt time.Time
+}
+
+// ValidateToken checks a token's signature and expiry, and that its session
+// has not been revoked
+func (h *Handler) ValidateToken(tokenString string) (*Claims, error) {
+	claims, err := h.Keys.ParseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	session, err := h.Sessions.Get(ctx, claims.SessionID)
+	if err != nil {
+		if !errors.Is(err, db.ErrSessionNotFound) {
+			log.Printf("Error loading session %s: %v", claims.SessionID, err)
+		}
+		return nil, ErrInvalidToken
+	}
+	if !session.Active(time.Now()) {
+		return nil, ErrRevokedToken
+	}
+
+	return claims, nil
+}
+
+// startSession logs a user in on a new session
+func (h *Handler) startSession(user *User) (*TokenPair, error) {
+	refreshToken, refreshHash, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &db.Session{
+		ID:        primitive.NewObjectID().Hex(),
+		UserID:    user.ID.Hex(),
+		CreatedAt: now,
+		ExpiresAt: now.Add(GetRefreshTokenTTL()),
+	}
+	token := &db.RefreshToken{
+		Hash:      refreshHash,
+		SessionID: session.ID,
+		UserID:    session.UserID,
+		CreatedAt: now,
+		ExpiresAt: session.ExpiresAt,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := h.Sessions.Create(ctx, session, token); err != nil {
+		return nil, err
+	}
+
+	accessToken, expiresAt, err := h.Keys.GenerateToken(session.UserID, user.Username, user.Role, session.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:      accessToken,
+		ExpiresAt:        expiresAt,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: token.ExpiresAt,
+	}, nil
+}
+
+// refreshSession exchanges a refresh token for a new token pair. A refresh
+// token that was already used revokes its whole session, since either the
+// client or an attacker is holding a stolen copy.
+func (h *Handler) refreshSession(refreshToken string) (*TokenPair, *User, error) {
+	nextToken, nextHash, err := newToken()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	next := &db.RefreshToken{
+		Hash:      nextHash,
+		CreatedAt: now,
+		ExpiresAt: now.Add(GetRefreshTokenTTL()),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	used, err := h.Sessions.Rotate(ctx, hashToken(refreshToken), next)
+	if errors.Is(err, db.ErrRefreshTokenReused) {
+		log.Printf("Refresh token reused, revoking session %s", used.SessionID)
+		if err := h.revokeSession(used.SessionID); err != nil {
+			log.Printf("Error revoking session %s: %v", used.SessionID, err)
+		}
+		return nil, nil, ErrInvalidRefreshToken
+	}
+	if errors.Is(err, db.ErrRefreshTokenNotFound) {
+		return nil, nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	session, err := h.Sessions.Get(ctx, used.SessionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !session.RevokedAt.IsZero() {
+		return nil, nil, ErrInvalidRefreshToken
+	}
+
+	user, err := h.Users.GetByID(ctx, used.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	user.Password = ""
+
+	accessToken, expiresAt, err := h.Keys.GenerateToken(used.UserID, user.Username, user.Role, used.SessionID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:      accessToken,
+		ExpiresAt:        expiresAt,
+		RefreshToken:     nextToken,
+		RefreshExpiresAt: next.ExpiresAt,
+	}, user, nil
+}
+
+// revokeSession ends a session and notifies OnSessionRevoked so its open
+// connections can be closed
+func (h *Handler) revokeSession(sessionID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := h.Sessions.Revoke(ctx, sessionID); err != nil {
+		return err
+	}
+
+	if h.OnSessionRevoked != nil {
+		h.OnSessionRevoked(sessionID)
+	}
+	return nil
+}
+
+// revokeUserSessions ends every session of a user, logging them out on all
+// devices
+func (h *Handler) revokeUserSessions(ctx context.Context, userID string) error {
+	sessionIDs, err := h.Sessions.RevokeAll(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	if h.OnSessionRevoked != nil {
+		for _, sessionID := range sessionIDs {
+			h.OnSessionRevoked(sessionID)
+		}
+	}
+	return nil
+}
+
+// sessionFromToken returns the session of a correctly signed token, even
+// one that has expired, so clients can log out without refreshing first
+func (h *Handler) sessionFromToken(tokenString string) (string, error) {
+	claims, err := h.Keys.ParseToken(tokenString, jwt.WithoutClaimsValidation())
+	if err != nil {
+		return "", err
+	}
+	return claims.SessionID, nil
+}
+
+// newToken returns a random opaque token, used for refresh and email
+// tokens, and the hash it is stored under
+func newToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
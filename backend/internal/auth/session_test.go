@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/db"
+)
+
+func TestRefreshSession(t *testing.T) {
+	// Which refresh token a step presents: the one issued at login, or the
+	// latest one issued by a successful refresh
+	const (
+		first  = "first"
+		latest = "latest"
+	)
+	type refresh struct {
+		token   string
+		wantErr error
+	}
+
+	tests := []struct {
+		name string
+		// revoke ends the session before any refresh
+		revoke    bool
+		refreshes []refresh
+		// wantValidateErr is what ValidateToken returns for the latest
+		// access token once the refreshes are done
+		wantValidateErr error
+	}{
+		{
+			name:      "each refresh issues the next token",
+			refreshes: []refresh{{token: first}, {token: latest}, {token: latest}},
+		},
+		{
+			name: "a reused token revokes the session",
+			refreshes: []refresh{
+				{token: first},
+				{token: first, wantErr: ErrInvalidRefreshToken},
+				// The token issued before the reuse dies with the session
+				{token: latest, wantErr: ErrInvalidRefreshToken},
+			},
+			wantValidateErr: ErrRevokedToken,
+		},
+		{
+			name:            "revoked session",
+			revoke:          true,
+			refreshes:       []refresh{{token: first, wantErr: ErrInvalidRefreshToken}},
+			wantValidateErr: ErrRevokedToken,
+		},
+		{
+			name:      "unknown token",
+			refreshes: []refresh{{token: "not-a-refresh-token", wantErr: ErrInvalidRefreshToken}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler(db.NewMemoryStore(), nil, NewHMACKeys([]byte("test-secret")))
+			var revoked []string
+			h.OnSessionRevoked = func(sessionID string) {
+				revoked = append(revoked, sessionID)
+			}
+
+			user, err := h.CreateUser("alice", "", "", "correct-horse-battery")
+			if err != nil {
+				t.Fatalf("CreateUser: %v", err)
+			}
+			tokens, err := h.startSession(user)
+			if err != nil {
+				t.Fatalf("startSession: %v", err)
+			}
+			claims, err := h.ValidateToken(tokens.AccessToken)
+			if err != nil {
+				t.Fatalf("ValidateToken after login: %v", err)
+			}
+
+			if tt.revoke {
+				if err := h.revokeSession(claims.SessionID); err != nil {
+					t.Fatalf("revokeSession: %v", err)
+				}
+			}
+
+			current := tokens
+			for i, step := range tt.refreshes {
+				token := step.token
+				switch token {
+				case first:
+					token = tokens.RefreshToken
+				case latest:
+					token = current.RefreshToken
+				}
+
+				next, _, err := h.refreshSession(token)
+				if !errors.Is(err, step.wantErr) {
+					t.Fatalf("refresh %d error = %v, want %v", i+1, err, step.wantErr)
+				}
+				if err == nil {
+					if next.RefreshToken == token {
+						t.Fatalf("refresh %d returned the same refresh token", i+1)
+					}
+					current = next
+				}
+			}
+
+			if _, err := h.ValidateToken(current.AccessToken); !errors.Is(err, tt.wantValidateErr) {
+				t.Errorf("ValidateToken error = %v, want %v", err, tt.wantValidateErr)
+			}
+			if wantRevoked := tt.wantValidateErr != nil; (len(revoked) > 0) != wantRevoked {
+				t.Errorf("revoked sessions = %v, want revoked %t", revoked, wantRevoked)
+			}
+		})
+	}
+}
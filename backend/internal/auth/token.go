@@ -2,7 +2,6 @@ package auth
 
 import (
 	"errors"
-	"os"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -11,56 +10,65 @@ import (
 var (
 	ErrInvalidToken = errors.New("invalid token")
 	ErrExpiredToken = errors.New("token has expired")
+	ErrRevokedToken = errors.New("token has been revoked")
 )
 
 type Claims struct {
 	UserID   string `json:"userID"`
 	Username string `json:"username"`
+	// SessionID ties the token to a login, see db.Session
+	SessionID string `json:"sid"`
+	// Role is the user's role when the token was issued. A role change
+	// revokes the user's sessions, so tokens never outlive their role.
+	Role Role `json:"role,omitempty"`
 	jwt.RegisteredClaims
 }
 
-// GetJWTSecret returns the JWT secret from environment or uses a default
-func GetJWTSecret() []byte {
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		// Default secret for development - should be changed in production
-		return []byte("minesweeper-secret-key-change-in-production")
-	}
-	return []byte(secret)
+// GetAccessTokenTTL returns how long access tokens are valid, from
+// ACCESS_TOKEN_TTL_MINUTES or 15 minutes by default
+func GetAccessTokenTTL() time.Duration {
+	return envDuration("ACCESS_TOKEN_TTL_MINUTES", time.Minute, 15*time.Minute)
+}
+
+// GetRefreshTokenTTL returns how long a refresh token is valid, from
+// REFRESH_TOKEN_TTL_DAYS or 30 days by default. Every refresh issues a new
+// token, so a session lasts as long as it is used at least this often.
+func GetRefreshTokenTTL() time.Duration {
+	return envDuration("REFRESH_TOKEN_TTL_DAYS", 24*time.Hour, 30*24*time.Hour)
 }
 
-// GenerateToken generates a JWT token for a user
-func GenerateToken(userID, username string) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour) // Token valid for 24 hours
+// GenerateToken generates a short-lived access token for a session and
+// returns it with its expiry
+func (k *KeySet) GenerateToken(userID, username string, role Role, sessionID string) (string, time.Time, error) {
+	now := time.Now()
+	expirationTime := now.Add(GetAccessTokenTTL())
 
 	claims := &Claims{
-		UserID:   userID,
-		Username: username,
+		UserID:    userID,
+		Username:  username,
+		SessionID: sessionID,
+		Role:      role,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			IssuedAt:  jwt.NewNumericDate(now),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(GetJWTSecret())
+	tokenString, err := k.sign(claims)
 	if err != nil {
-		return "", err
+		return "", time.Time{}, err
 	}
 
-	return tokenString, nil
+	return tokenString, expirationTime, nil
 }
 
-// ValidateToken validates a JWT token and returns the claims
-func ValidateToken(tokenString string) (*Claims, error) {
+// ParseToken checks a token's signature and expiry and returns the claims.
+// It does not check whether the session was revoked; use
+// Handler.ValidateToken for that.
+func (k *KeySet) ParseToken(tokenString string, options ...jwt.ParserOption) (*Claims, error) {
 	claims := &Claims{}
 
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, ErrInvalidToken
-		}
-		return GetJWTSecret(), nil
-	})
+	token, err := jwt.ParseWithClaims(tokenString, claims, k.verificationKey, options...)
 
 	if err != nil {
 		if errors.Is(err, jwt.ErrTokenExpired) {
@@ -69,7 +77,7 @@ func ValidateToken(tokenString string) (*Claims, error) {
 		return nil, ErrInvalidToken
 	}
 
-	if !token.Valid {
+	if !token.Valid || claims.SessionID == "" {
 		return nil, ErrInvalidToken
 	}
 
@@ -3,41 +3,42 @@ package auth
 import (
 	"context"
 	"errors"
+	"sync"
 	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/crypto/bcrypt"
 
 	"github.com/gameoflife0880/web_minesweeper/backend/internal/db"
 )
 
 var (
-	ErrUserNotFound       = errors.New("user not found")
+	ErrUserNotFound       = db.ErrUserNotFound
 	ErrInvalidCredentials = errors.New("invalid credentials")
-	ErrUserExists         = errors.New("user already exists")
+	ErrUserExists         = db.ErrUserExists
 )
 
-type User struct {
-	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	Username  string             `bson:"username" json:"username"`
-	Email     string             `bson:"email" json:"email"`
-	Password  string             `bson:"password" json:"-"`
-	CreatedAt time.Time          `bson:"createdAt" json:"createdAt"`
-	UpdatedAt time.Time          `bson:"updatedAt" json:"updatedAt"`
-}
+type User = db.User
 
-const usersCollection = "users"
+type Role = db.Role
 
-// CreateUser creates a new user with hashed password
-func CreateUser(username, email, password string) (*User, error) {
-	// Check if user already exists
-	existingUser, _ := GetUserByUsername(username)
-	if existingUser != nil {
-		return nil, ErrUserExists
+const (
+	RolePlayer    = db.RolePlayer
+	RoleModerator = db.RoleModerator
+	RoleAdmin     = db.RoleAdmin
+)
+
+// dummyPasswordHash is compared against when a user does not exist
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, err := bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+	if err != nil {
+		panic(err)
 	}
+	return hash
+})
 
+// CreateUser creates a new user with hashed password
+func (h *Handler) CreateUser(username, displayName, email, password string) (*User, error) {
 	// Hash password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -46,20 +47,20 @@ func CreateUser(username, email, password string) (*User, error) {
 
 	now := time.Now()
 	user := &User{
-		ID:        primitive.NewObjectID(),
-		Username:  username,
-		Email:     email,
-		Password:  string(hashedPassword),
-		CreatedAt: now,
-		UpdatedAt: now,
+		ID:          primitive.NewObjectID(),
+		Username:    username,
+		DisplayName: displayName,
+		Email:       email,
+		Password:    string(hashedPassword),
+		Role:        RolePlayer,
+		CreatedAt:   now,
+		UpdatedAt:   now,
 	}
 
-	collection := db.Database.Collection(usersCollection)
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	_, err = collection.InsertOne(ctx, user)
-	if err != nil {
+	if err := h.Users.Create(ctx, user); err != nil {
 		return nil, err
 	}
 
@@ -68,51 +69,33 @@ func CreateUser(username, email, password string) (*User, error) {
 	return user, nil
 }
 
-// GetUserByUsername retrieves a user by username
-func GetUserByUsername(username string) (*User, error) {
-	collection := db.Database.Collection(usersCollection)
+// GetUserByID retrieves a user by ID
+func (h *Handler) GetUserByID(userID string) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	var user User
-	err := collection.FindOne(ctx, bson.M{"username": username}).Decode(&user)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return nil, ErrUserNotFound
-		}
-		return nil, err
-	}
-
-	return &user, nil
+	return h.Users.GetByID(ctx, userID)
 }
 
-// GetUserByID retrieves a user by ID
-func GetUserByID(userID string) (*User, error) {
-	collection := db.Database.Collection(usersCollection)
+// AuthenticateUser verifies username and password
+func (h *Handler) AuthenticateUser(username, password string) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	objectID, err := primitive.ObjectIDFromHex(userID)
+	user, err := h.Users.GetByUsername(ctx, username)
 	if err != nil {
-		return nil, ErrUserNotFound
-	}
-
-	var user User
-	err = collection.FindOne(ctx, bson.M{"_id": objectID}).Decode(&user)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return nil, ErrUserNotFound
+		if errors.Is(err, ErrUserNotFound) {
+			// Compare anyway so unknown usernames take as long as wrong
+			// passwords
+			bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+			return nil, ErrInvalidCredentials
 		}
 		return nil, err
 	}
 
-	return &user, nil
-}
-
-// AuthenticateUser verifies username and password
-func AuthenticateUser(username, password string) (*User, error) {
-	user, err := GetUserByUsername(username)
-	if err != nil {
+	// Accounts created through a login provider may have no password
+	if user.Password == "" {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
 		return nil, ErrInvalidCredentials
 	}
 
@@ -0,0 +1,262 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/mail"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gameoflife0880/web_minesweeper/backend/pkg"
+)
+
+// Codes of field validation errors, for clients that show their own
+// messages
+const (
+	CodeRequired          = "required"
+	CodeTooShort          = "too_short"
+	CodeTooLong           = "too_long"
+	CodeInvalidCharacters = "invalid_characters"
+	CodeReserved          = "reserved"
+	CodeInvalid           = "invalid"
+	CodeTooWeak           = "too_weak"
+	CodeBreached          = "breached"
+	CodeSameAsUsername    = "same_as_username"
+)
+
+// maxPasswordBytes is the most bcrypt hashes; anything after is ignored
+const maxPasswordBytes = 72
+
+// FieldError explains why one field of a request was rejected
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every invalid field of a request
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Fields))
+	for _, field := range e.Fields {
+		messages = append(messages, field.Field+": "+field.Message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e *ValidationError) add(field, code, message string) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Code: code, Message: message})
+}
+
+// err returns e if any field was invalid, and nil otherwise
+func (e *ValidationError) err() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+// ValidationRules are the requirements for account fields
+type ValidationRules struct {
+	UsernameMinLength int
+	UsernameMaxLength int
+	// ReservedNames cannot be used as usernames or display names, compared
+	// case-insensitively
+	ReservedNames map[string]bool
+
+	PasswordMinLength int
+	// PasswordMinClasses is how many of lowercase letters, uppercase
+	// letters, digits and symbols a password must mix
+	PasswordMinClasses int
+	// BreachedPasswords are known leaked passwords, stored lowercase
+	BreachedPasswords map[string]bool
+}
+
+// IsReserved reports whether name is one of the reserved names
+func (r ValidationRules) IsReserved(name string) bool {
+	return r.ReservedNames[strings.ToLower(name)]
+}
+
+var defaultReservedNames = []string{
+	"admin", "administrator", "root", "system", "moderator", "mod", "support",
+	"staff", "server", "host", "guest", "anonymous", "null", "undefined",
+}
+
+// commonPasswords are rejected even without a breached password list
+var commonPasswords = []string{
+	"password", "password1", "password123", "passw0rd", "12345678", "123456789",
+	"1234567890", "11111111", "00000000", "87654321", "qwertyuiop", "qwerty123",
+	"1q2w3e4r", "1qaz2wsx", "abc12345", "abcd1234", "aa123456", "iloveyou",
+	"sunshine", "princess", "football", "baseball", "superman", "trustno1",
+	"letmein1", "welcome1", "admin123", "dragon123", "monkey123", "minesweeper",
+}
+
+// LoadValidationRules reads the rules from the environment:
+// USERNAME_MIN_LENGTH and USERNAME_MAX_LENGTH (3 and 20 by default),
+// RESERVED_USERNAMES, a comma-separated list added to the built-in one,
+// PASSWORD_MIN_LENGTH (8), PASSWORD_MIN_CLASSES (2) and
+// BREACHED_PASSWORDS_FILE, a file of leaked passwords, one per line
+func LoadValidationRules() ValidationRules {
+	rules := ValidationRules{
+		UsernameMinLength:  envInt("USERNAME_MIN_LENGTH", 3),
+		UsernameMaxLength:  envInt("USERNAME_MAX_LENGTH", 20),
+		ReservedNames:      make(map[string]bool),
+		PasswordMinLength:  min(envInt("PASSWORD_MIN_LENGTH", 8), maxPasswordBytes),
+		PasswordMinClasses: min(envInt("PASSWORD_MIN_CLASSES", 2), 4),
+		BreachedPasswords:  make(map[string]bool),
+	}
+
+	for _, name := range append(defaultReservedNames, envList("RESERVED_USERNAMES")...) {
+		rules.ReservedNames[strings.ToLower(name)] = true
+	}
+
+	for _, password := range commonPasswords {
+		rules.BreachedPasswords[password] = true
+	}
+	if path := os.Getenv("BREACHED_PASSWORDS_FILE"); path != "" {
+		count, err := loadBreachedPasswords(path, rules.BreachedPasswords)
+		if err != nil {
+			log.Printf("Failed to load breached passwords from %s: %v", path, err)
+		} else {
+			log.Printf("Loaded %d breached passwords from %s", count, path)
+		}
+	}
+
+	return rules
+}
+
+func loadBreachedPasswords(path string, into map[string]bool) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if password := strings.TrimSpace(scanner.Text()); password != "" {
+			into[strings.ToLower(password)] = true
+			count++
+		}
+	}
+	return count, scanner.Err()
+}
+
+// ValidateRegistration checks every field of a registration and returns a
+// *ValidationError listing the invalid ones
+func (rules ValidationRules) ValidateRegistration(req RegisterRequest) error {
+	errs := &ValidationError{}
+	rules.checkUsername(errs, "username", req.Username)
+	if req.DisplayName != "" {
+		rules.checkDisplayName(errs, "displayName", req.DisplayName)
+	}
+	if req.Email != "" {
+		rules.checkEmail(errs, "email", req.Email)
+	}
+	rules.checkPassword(errs, "password", req.Password, req.Username)
+	return errs.err()
+}
+
+// ValidateProfile checks the fields a profile update sets
+func (rules ValidationRules) ValidateProfile(req UpdateProfileRequest) error {
+	errs := &ValidationError{}
+	if req.DisplayName != nil && *req.DisplayName != "" {
+		rules.checkDisplayName(errs, "displayName", *req.DisplayName)
+	}
+	if req.Email != nil && *req.Email != "" {
+		rules.checkEmail(errs, "email", *req.Email)
+	}
+	return errs.err()
+}
+
+// ValidatePassword checks a new password for the account with username
+func (rules ValidationRules) ValidatePassword(field, password, username string) error {
+	errs := &ValidationError{}
+	rules.checkPassword(errs, field, password, username)
+	return errs.err()
+}
+
+func (rules ValidationRules) checkUsername(errs *ValidationError, field, username string) {
+	length := utf8.RuneCountInString(username)
+	switch {
+	case username == "":
+		errs.add(field, CodeRequired, "Username is required")
+	case length < rules.UsernameMinLength:
+		errs.add(field, CodeTooShort, fmt.Sprintf("Username must be at least %d characters", rules.UsernameMinLength))
+	case length > rules.UsernameMaxLength:
+		errs.add(field, CodeTooLong, fmt.Sprintf("Username must be at most %d characters", rules.UsernameMaxLength))
+	case !pkg.ValidNameCharset(username):
+		errs.add(field, CodeInvalidCharacters, "Username may only contain letters, digits, '_' and '-'")
+	case rules.IsReserved(username):
+		errs.add(field, CodeReserved, "Username is reserved")
+	}
+}
+
+func (rules ValidationRules) checkDisplayName(errs *ValidationError, field, name string) {
+	switch err := pkg.ValidateNickname(name); {
+	case err == pkg.ErrNicknameLength && len(name) < pkg.MinNicknameLength:
+		errs.add(field, CodeTooShort, "Display name is too short: "+err.Error())
+	case err == pkg.ErrNicknameLength:
+		errs.add(field, CodeTooLong, "Display name is too long: "+err.Error())
+	case err != nil:
+		errs.add(field, CodeInvalidCharacters, "Display name is invalid: "+err.Error())
+	case rules.IsReserved(name):
+		errs.add(field, CodeReserved, "Display name is reserved")
+	}
+}
+
+func (rules ValidationRules) checkEmail(errs *ValidationError, field, email string) {
+	// ParseAddress also accepts "Name <address>", so require the bare
+	// address back
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email || !strings.Contains(email[strings.LastIndex(email, "@"):], ".") {
+		errs.add(field, CodeInvalid, "Email is not a valid address")
+		return
+	}
+	if len(email) > 254 {
+		errs.add(field, CodeTooLong, "Email must be at most 254 characters")
+	}
+}
+
+func (rules ValidationRules) checkPassword(errs *ValidationError, field, password, username string) {
+	switch {
+	case password == "":
+		errs.add(field, CodeRequired, "Password is required")
+	case utf8.RuneCountInString(password) < rules.PasswordMinLength:
+		errs.add(field, CodeTooShort, fmt.Sprintf("Password must be at least %d characters", rules.PasswordMinLength))
+	case len(password) > maxPasswordBytes:
+		errs.add(field, CodeTooLong, fmt.Sprintf("Password must be at most %d bytes", maxPasswordBytes))
+	case username != "" && strings.EqualFold(password, username):
+		errs.add(field, CodeSameAsUsername, "Password cannot be the same as the username")
+	case characterClasses(password) < rules.PasswordMinClasses:
+		errs.add(field, CodeTooWeak, fmt.Sprintf("Password must mix at least %d of lowercase letters, uppercase letters, digits and symbols", rules.PasswordMinClasses))
+	case rules.BreachedPasswords[strings.ToLower(password)]:
+		errs.add(field, CodeBreached, "Password is too common or has appeared in a data breach")
+	}
+}
+
+// characterClasses counts which of lowercase letters, uppercase letters,
+// digits and symbols a password uses
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol int
+	for _, char := range password {
+		switch {
+		case unicode.IsLower(char):
+			lower = 1
+		case unicode.IsUpper(char):
+			upper = 1
+		case unicode.IsDigit(char):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
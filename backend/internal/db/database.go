@@ -2,26 +2,63 @@ package db
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"os"
 	"time"
 
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-var (
-	Client   *mongo.Client
-	Database *mongo.Database
-)
-
 const (
 	DefaultMongoURI   = "mongodb://localhost:27017"
 	DefaultDatabase   = "minesweeper"
 	ConnectionTimeout = 10 * time.Second
 )
 
-// Init initializes the MongoDB connection
-func Init(mongoURI, databaseName string) error {
+const (
+	BackendMongo  = "mongo"
+	BackendMemory = "memory"
+)
+
+// Config selects and configures the storage backend
+type Config struct {
+	Backend      string
+	MongoURI     string
+	DatabaseName string
+}
+
+// LoadConfig reads the storage configuration from the environment.
+// STORAGE_BACKEND is "mongo" (the default) or "memory".
+func LoadConfig() Config {
+	backend := os.Getenv("STORAGE_BACKEND")
+	if backend == "" {
+		backend = BackendMongo
+	}
+
+	return Config{
+		Backend:      backend,
+		MongoURI:     os.Getenv("MONGO_URI"),
+		DatabaseName: os.Getenv("MONGO_DATABASE"),
+	}
+}
+
+// Open returns the store for the configured backend
+func Open(config Config) (*Store, error) {
+	switch config.Backend {
+	case BackendMongo:
+		return openMongo(config.MongoURI, config.DatabaseName)
+	case BackendMemory:
+		log.Println("Using in-memory storage, data will be lost on restart")
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", config.Backend)
+	}
+}
+
+// openMongo connects to MongoDB and returns a store backed by it
+func openMongo(mongoURI, databaseName string) (*Store, error) {
 	if mongoURI == "" {
 		mongoURI = DefaultMongoURI
 	}
@@ -35,27 +72,37 @@ func Init(mongoURI, databaseName string) error {
 	clientOptions := options.Client().ApplyURI(mongoURI)
 	client, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Ping the database to verify connection
 	if err := client.Ping(ctx, nil); err != nil {
-		return err
+		return nil, err
 	}
 
-	Client = client
-	Database = client.Database(databaseName)
+	database := client.Database(databaseName)
 
 	log.Printf("Connected to MongoDB: %s, Database: %s", mongoURI, databaseName)
-	return nil
-}
 
-// Close closes the MongoDB connection
-func Close() error {
-	if Client != nil {
-		ctx, cancel := context.WithTimeout(context.Background(), ConnectionTimeout)
-		defer cancel()
-		return Client.Disconnect(ctx)
-	}
-	return nil
+	return &Store{
+		Users:     &mongoUsers{collection: database.Collection(usersCollection)},
+		Matches:   &mongoMatches{collection: database.Collection(matchesCollection)},
+		Replays:   &mongoReplays{collection: database.Collection(replaysCollection)},
+		Stats:     &mongoStats{collection: database.Collection(statsCollection)},
+		Snapshots: &mongoSnapshots{collection: database.Collection(snapshotsCollection)},
+		Sessions: &mongoSessions{
+			sessions:      database.Collection(sessionsCollection),
+			refreshTokens: database.Collection(refreshTokensCollection),
+		},
+
+		EmailTokens: &mongoEmailTokens{collection: database.Collection(emailTokensCollection)},
+
+		Migrations: &mongoMigrator{database: database},
+
+		close: func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), ConnectionTimeout)
+			defer cancel()
+			return client.Disconnect(ctx)
+		},
+	}, nil
 }
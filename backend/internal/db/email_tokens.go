@@ -0,0 +1,93 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrEmailTokenNotFound = errors.New("email token not found")
+
+// EmailTokenPurpose is what an email token can be used for
+type EmailTokenPurpose string
+
+const (
+	PurposeVerifyEmail   EmailTokenPurpose = "verify_email"
+	PurposeResetPassword EmailTokenPurpose = "reset_password"
+)
+
+// EmailToken is a single-use token sent to a user's email address to prove
+// they can read it. Only a hash of the token is stored.
+type EmailToken struct {
+	Hash    string            `bson:"_id"`
+	Purpose EmailTokenPurpose `bson:"purpose"`
+	UserID  string            `bson:"userID"`
+	// Email is the address the token was sent to
+	Email     string    `bson:"email"`
+	CreatedAt time.Time `bson:"createdAt"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+const emailTokensCollection = "email_tokens"
+
+type mongoEmailTokens struct {
+	collection *mongo.Collection
+}
+
+func (r *mongoEmailTokens) Create(ctx context.Context, token *EmailToken) error {
+	_, err := r.collection.DeleteMany(ctx, bson.M{"userID": token.UserID, "purpose": token.Purpose})
+	if err != nil {
+		return err
+	}
+
+	_, err = r.collection.InsertOne(ctx, token)
+	return err
+}
+
+func (r *mongoEmailTokens) Consume(ctx context.Context, hash string, purpose EmailTokenPurpose) (*EmailToken, error) {
+	// Deleting the token as it is read means it can only be used once
+	var token EmailToken
+	err := r.collection.FindOneAndDelete(ctx, bson.M{
+		"_id":       hash,
+		"purpose":   purpose,
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}).Decode(&token)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrEmailTokenNotFound
+		}
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+func (r *mongoEmailTokens) Latest(ctx context.Context, userID string, purpose EmailTokenPurpose) (*EmailToken, error) {
+	var token EmailToken
+	err := r.collection.FindOne(ctx, bson.M{
+		"userID":    userID,
+		"purpose":   purpose,
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}, options.FindOne().SetSort(bson.M{"createdAt": -1})).Decode(&token)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrEmailTokenNotFound
+		}
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// emailTokenIndexes expire email tokens and look up a user's tokens
+func emailTokenIndexes(ctx context.Context, database *mongo.Database) error {
+	_, err := database.Collection(emailTokensCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "userID", Value: 1}, {Key: "purpose", Value: 1}}},
+		{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	return err
+}
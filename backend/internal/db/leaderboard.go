@@ -0,0 +1,202 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type LeaderboardWindow string
+
+const (
+	WindowDaily   LeaderboardWindow = "daily"
+	WindowWeekly  LeaderboardWindow = "weekly"
+	WindowAllTime LeaderboardWindow = "all"
+)
+
+var ErrInvalidWindow = errors.New("invalid leaderboard window")
+
+// Since returns the start of the window containing now, in UTC. Weeks start
+// on Monday. The all-time window returns the zero time.
+func (w LeaderboardWindow) Since(now time.Time) (time.Time, error) {
+	now = now.UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	switch w {
+	case WindowDaily:
+		return today, nil
+	case WindowWeekly:
+		daysSinceMonday := (int(today.Weekday()) + 6) % 7
+		return today.AddDate(0, 0, -daysSinceMonday), nil
+	case WindowAllTime:
+		return time.Time{}, nil
+	default:
+		return time.Time{}, ErrInvalidWindow
+	}
+}
+
+// LeaderboardEntry is an account's aggregated results within a window
+type LeaderboardEntry struct {
+	Rank        int    `bson:"-" json:"rank"`
+	PlayerID    string `bson:"_id" json:"playerID"`
+	PlayerName  string `bson:"playerName" json:"playerName"`
+	TotalScore  int    `bson:"totalScore" json:"totalScore"`
+	GamesPlayed int    `bson:"gamesPlayed" json:"gamesPlayed"`
+	BestScore   int    `bson:"bestScore" json:"bestScore"`
+}
+
+type LeaderboardQuery struct {
+	Window    LeaderboardWindow
+	ConfigKey string
+	Offset    int
+	Limit     int
+}
+
+// leaderboardPipeline groups the logged-in participants of matching rounds
+// by account, ordered by total score
+func leaderboardPipeline(since time.Time, configKey string) mongo.Pipeline {
+	return mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"configKey": configKey,
+			"endedAt":   bson.M{"$gte": since},
+		}}},
+		{{Key: "$sort", Value: bson.M{"endedAt": 1}}},
+		{{Key: "$unwind", Value: "$participants"}},
+		{{Key: "$match", Value: bson.M{"participants.isLoggedIn": true}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":         "$participants.playerID",
+			"playerName":  bson.M{"$last": "$participants.playerName"},
+			"totalScore":  bson.M{"$sum": "$participants.score"},
+			"gamesPlayed": bson.M{"$sum": 1},
+			"bestScore":   bson.M{"$max": "$participants.score"},
+		}}},
+	}
+}
+
+func (r *mongoMatches) Leaderboard(ctx context.Context, query LeaderboardQuery) ([]LeaderboardEntry, int, error) {
+	since, err := query.Window.Since(time.Now())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	pipeline := append(leaderboardPipeline(since, query.ConfigKey),
+		bson.D{{Key: "$facet", Value: bson.M{
+			"entries": bson.A{
+				bson.M{"$sort": bson.D{{Key: "totalScore", Value: -1}, {Key: "_id", Value: 1}}},
+				bson.M{"$skip": query.Offset},
+				bson.M{"$limit": query.Limit},
+			},
+			"total": bson.A{bson.M{"$count": "count"}},
+		}}},
+	)
+
+	cursor, err := r.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var results []struct {
+		Entries []LeaderboardEntry `bson:"entries"`
+		Total   []struct {
+			Count int `bson:"count"`
+		} `bson:"total"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, 0, err
+	}
+	if len(results) == 0 {
+		return []LeaderboardEntry{}, 0, nil
+	}
+
+	entries := results[0].Entries
+	if len(entries) > 0 {
+		ahead, err := r.playersAhead(ctx, since, query.ConfigKey, entries[0].TotalScore)
+		if err != nil {
+			return nil, 0, err
+		}
+		rankEntries(entries, query.Offset, ahead)
+	}
+
+	total := 0
+	if len(results[0].Total) > 0 {
+		total = results[0].Total[0].Count
+	}
+
+	return entries, total, nil
+}
+
+func (r *mongoMatches) LeaderboardRank(ctx context.Context, query LeaderboardQuery, playerID string) (*LeaderboardEntry, error) {
+	since, err := query.Window.Since(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := r.collection.Aggregate(ctx, append(leaderboardPipeline(since, query.ConfigKey),
+		bson.D{{Key: "$match", Value: bson.M{"_id": playerID}}},
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	var own []LeaderboardEntry
+	if err := cursor.All(ctx, &own); err != nil {
+		return nil, err
+	}
+	if len(own) == 0 {
+		return nil, nil
+	}
+	entry := own[0]
+
+	ahead, err := r.playersAhead(ctx, since, query.ConfigKey, entry.TotalScore)
+	if err != nil {
+		return nil, err
+	}
+	entry.Rank = ahead + 1
+
+	return &entry, nil
+}
+
+// playersAhead counts the accounts with a higher total score than score
+func (r *mongoMatches) playersAhead(ctx context.Context, since time.Time, configKey string, score int) (int, error) {
+	cursor, err := r.collection.Aggregate(ctx, append(leaderboardPipeline(since, configKey),
+		bson.D{{Key: "$match", Value: bson.M{"totalScore": bson.M{"$gt": score}}}},
+		bson.D{{Key: "$count", Value: "count"}},
+	))
+	if err != nil {
+		return 0, err
+	}
+
+	var ahead []struct {
+		Count int `bson:"count"`
+	}
+	if err := cursor.All(ctx, &ahead); err != nil {
+		return 0, err
+	}
+	if len(ahead) == 0 {
+		return 0, nil
+	}
+	return ahead[0].Count, nil
+}
+
+// rankEntries ranks a page of entries ordered by total score, starting at
+// offset in the full leaderboard. Accounts with equal totals share a rank
+// and the ranks after them are skipped, so rank is always one more than
+// the number of accounts ahead, as in LeaderboardRank. ahead counts the
+// accounts ahead of the page's first entry, which may be tied with the
+// previous page.
+func rankEntries(entries []LeaderboardEntry, offset, ahead int) {
+	for i := range entries {
+		switch {
+		case i == 0:
+			entries[i].Rank = ahead + 1
+		case entries[i].TotalScore == entries[i-1].TotalScore:
+			entries[i].Rank = entries[i-1].Rank
+		default:
+			entries[i].Rank = offset + i + 1
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrMatchNotFound = errors.New("match not found")
+
+// BoardConfig describes the rules a round was played with
+type BoardConfig struct {
+	Size            int     `bson:"size" json:"size"`
+	MinesMultiplier float64 `bson:"minesMultiplier" json:"minesMultiplier"`
+	RevealReward    int     `bson:"revealReward" json:"revealReward"`
+	MineHitPenalty  int     `bson:"mineHitPenalty" json:"mineHitPenalty"`
+}
+
+// Key identifies the config, so rounds played with the same rules can be
+// ranked together
+func (c BoardConfig) Key() string {
+	return fmt.Sprintf("%dx%d-%.2f-%d-%d", c.Size, c.Size, c.MinesMultiplier, c.RevealReward, c.MineHitPenalty)
+}
+
+// MatchParticipant is a player's final result in a round
+type MatchParticipant struct {
+	PlayerID     string `bson:"playerID" json:"playerID"`
+	PlayerName   string `bson:"playerName" json:"playerName"`
+	IsLoggedIn   bool   `bson:"isLoggedIn" json:"isLoggedIn"`
+	Score        int    `bson:"score" json:"score"`
+	Reveals      int    `bson:"reveals" json:"reveals"`
+	MineHits     int    `bson:"mineHits" json:"mineHits"`
+	Flags        int    `bson:"flags" json:"flags"`
+	CorrectFlags int    `bson:"correctFlags" json:"correctFlags"`
+	// PlayTime is how long the player was in the round, in milliseconds.
+	// Rounds stored before it was recorded leave it at 0.
+	PlayTime int64 `bson:"playTime,omitempty" json:"playTime"`
+}
+
+// Match is the record of a finished round
+type Match struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Config    BoardConfig        `bson:"config" json:"config"`
+	ConfigKey string             `bson:"configKey" json:"configKey"`
+	Seed      int64              `bson:"seed" json:"seed"`
+	StartedAt time.Time          `bson:"startedAt" json:"startedAt"`
+	EndedAt   time.Time          `bson:"endedAt" json:"endedAt"`
+	Mines     [][2]int           `bson:"mines" json:"mines"`
+	// FinalBoard holds one string per board row, see game.EncodeBoardRows
+	FinalBoard   []string           `bson:"finalBoard" json:"finalBoard"`
+	Participants []MatchParticipant `bson:"participants" json:"participants"`
+}
+
+const matchesCollection = "matches"
+
+type mongoMatches struct {
+	collection *mongo.Collection
+}
+
+func (r *mongoMatches) Insert(ctx context.Context, match *Match) error {
+	prepareMatch(match)
+
+	_, err := r.collection.InsertOne(ctx, match)
+	return err
+}
+
+// prepareMatch fills in the generated fields of a new match
+func prepareMatch(match *Match) {
+	if match.ID.IsZero() {
+		match.ID = primitive.NewObjectID()
+	}
+	match.ConfigKey = match.Config.Key()
+}
+
+func (r *mongoMatches) Get(ctx context.Context, matchID string) (*Match, error) {
+	objectID, err := primitive.ObjectIDFromHex(matchID)
+	if err != nil {
+		return nil, ErrMatchNotFound
+	}
+
+	var match Match
+	err = r.collection.FindOne(ctx, bson.M{"_id": objectID}).Decode(&match)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrMatchNotFound
+		}
+		return nil, err
+	}
+
+	return &match, nil
+}
+
+// MatchFilter selects a player's matches. Zero values are ignored.
+type MatchFilter struct {
+	PlayerID  string
+	From      time.Time
+	To        time.Time
+	ConfigKey string
+	Offset    int
+	Limit     int
+}
+
+func (f MatchFilter) query() bson.M {
+	query := bson.M{}
+	if f.PlayerID != "" {
+		query["participants.playerID"] = f.PlayerID
+	}
+	if f.ConfigKey != "" {
+		query["configKey"] = f.ConfigKey
+	}
+
+	endedAt := bson.M{}
+	if !f.From.IsZero() {
+		endedAt["$gte"] = f.From
+	}
+	if !f.To.IsZero() {
+		endedAt["$lt"] = f.To
+	}
+	if len(endedAt) > 0 {
+		query["endedAt"] = endedAt
+	}
+
+	return query
+}
+
+func (r *mongoMatches) List(ctx context.Context, filter MatchFilter) ([]Match, int, error) {
+	query := filter.query()
+
+	total, err := r.collection.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "endedAt", Value: -1}}).
+		SetSkip(int64(filter.Offset)).
+		SetLimit(int64(filter.Limit)).
+		SetProjection(bson.M{"mines": 0, "finalBoard": 0})
+
+	cursor, err := r.collection.Find(ctx, query, findOptions)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	matches := make([]Match, 0)
+	if err := cursor.All(ctx, &matches); err != nil {
+		return nil, 0, err
+	}
+
+	return matches, int(total), nil
+}
+
+func (r *mongoMatches) Each(ctx context.Context, filter MatchFilter, fn func(*Match) error) error {
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "endedAt", Value: 1}}).
+		SetProjection(bson.M{"mines": 0, "finalBoard": 0})
+
+	cursor, err := r.collection.Find(ctx, filter.query(), findOptions)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var match Match
+		if err := cursor.Decode(&match); err != nil {
+			return err
+		}
+		if err := fn(&match); err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
+
+func (r *mongoMatches) Reassign(ctx context.Context, playerID string, to ReplayPlayer, isLoggedIn bool) error {
+	_, err := r.collection.UpdateMany(ctx,
+		bson.M{"participants.playerID": playerID},
+		bson.M{"$set": bson.M{
+			"participants.$[participant].playerID":   to.PlayerID,
+			"participants.$[participant].playerName": to.PlayerName,
+			"participants.$[participant].isLoggedIn": isLoggedIn,
+		}},
+		options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{
+			bson.M{"participant.playerID": playerID},
+		}}),
+	)
+	return err
+}
@@ -0,0 +1,656 @@
+package db
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// NewMemoryStore returns a store that keeps everything in process memory.
+// It is meant for local development and tests; nothing survives a restart.
+func NewMemoryStore() *Store {
+	return &Store{
+		Users:     &memoryUsers{users: make(map[string]User)},
+		Matches:   &memoryMatches{matches: make(map[primitive.ObjectID]Match)},
+		Replays:   &memoryReplays{replays: make(map[primitive.ObjectID]Replay)},
+		Stats:     &memoryStats{stats: make(map[string]UserStats)},
+		Snapshots: &memorySnapshots{snapshots: make(map[string]RoomSnapshot)},
+		Sessions: &memorySessions{
+			sessions:      make(map[string]Session),
+			refreshTokens: make(map[string]RefreshToken),
+		},
+
+		EmailTokens: &memoryEmailTokens{tokens: make(map[string]EmailToken)},
+
+		Migrations: &memoryMigrator{openedAt: time.Now()},
+	}
+}
+
+type memoryUsers struct {
+	mu    sync.RWMutex
+	users map[string]User
+}
+
+func (r *memoryUsers) Create(ctx context.Context, user *User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, existing := range r.users {
+		if err := usersConflict(&existing, user); err != nil {
+			return err
+		}
+	}
+
+	prepareUser(user)
+	if user.ID.IsZero() {
+		user.ID = primitive.NewObjectID()
+	}
+	stored := *user
+	stored.Identities = slices.Clone(user.Identities)
+	r.users[user.ID.Hex()] = stored
+	return nil
+}
+
+func (r *memoryUsers) GetByUsername(ctx context.Context, username string) (*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, user := range r.users {
+		if user.Username == username {
+			return &user, nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+func (r *memoryUsers) GetByEmail(ctx context.Context, email string) (*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, user := range r.users {
+		if email != "" && user.Email == email {
+			return &user, nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+func (r *memoryUsers) GetByIdentity(ctx context.Context, provider, subject string) (*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, user := range r.users {
+		if user.HasIdentity(provider, subject) {
+			return &user, nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+func (r *memoryUsers) GetByID(ctx context.Context, userID string) (*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	user, ok := r.users[userID]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return &user, nil
+}
+
+func (r *memoryUsers) Update(ctx context.Context, user *User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id := user.ID.Hex()
+	if _, ok := r.users[id]; !ok {
+		return ErrUserNotFound
+	}
+	for existingID, existing := range r.users {
+		if existingID == id {
+			continue
+		}
+		if err := usersConflict(&existing, user); err != nil {
+			return err
+		}
+	}
+
+	prepareUser(user)
+
+	stored := *user
+	stored.Identities = slices.Clone(user.Identities)
+	r.users[id] = stored
+	return nil
+}
+
+// usersConflict returns ErrIdentityExists if two users share a linked
+// identity, or ErrUserExists if they share a username or email, as the
+// unique indexes would in Mongo
+func usersConflict(existing, user *User) error {
+	for _, identity := range user.Identities {
+		if existing.HasIdentity(identity.Provider, identity.Subject) {
+			return ErrIdentityExists
+		}
+	}
+	if existing.Username == user.Username || (user.Email != "" && existing.Email == user.Email) {
+		return ErrUserExists
+	}
+	return nil
+}
+
+func (r *memoryUsers) Delete(ctx context.Context, userID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.users[userID]; !ok {
+		return ErrUserNotFound
+	}
+	delete(r.users, userID)
+	return nil
+}
+
+type memoryMatches struct {
+	mu      sync.RWMutex
+	matches map[primitive.ObjectID]Match
+}
+
+func (r *memoryMatches) Insert(ctx context.Context, match *Match) error {
+	prepareMatch(match)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.matches[match.ID] = *match
+	return nil
+}
+
+func (r *memoryMatches) Get(ctx context.Context, matchID string) (*Match, error) {
+	objectID, err := primitive.ObjectIDFromHex(matchID)
+	if err != nil {
+		return nil, ErrMatchNotFound
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	match, ok := r.matches[objectID]
+	if !ok {
+		return nil, ErrMatchNotFound
+	}
+	return &match, nil
+}
+
+func (r *memoryMatches) List(ctx context.Context, filter MatchFilter) ([]Match, int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	matches := make([]Match, 0)
+	for _, match := range r.matches {
+		if filter.matches(match) {
+			match.Mines = nil
+			match.FinalBoard = nil
+			matches = append(matches, match)
+		}
+	}
+
+	slices.SortFunc(matches, func(a, b Match) int {
+		return b.EndedAt.Compare(a.EndedAt)
+	})
+
+	return page(matches, filter.Offset, filter.Limit), len(matches), nil
+}
+
+func (r *memoryMatches) Each(ctx context.Context, filter MatchFilter, fn func(*Match) error) error {
+	r.mu.RLock()
+	matches := make([]Match, 0)
+	for _, match := range r.matches {
+		if filter.matches(match) {
+			match.Mines = nil
+			match.FinalBoard = nil
+			matches = append(matches, match)
+		}
+	}
+	r.mu.RUnlock()
+
+	slices.SortFunc(matches, func(a, b Match) int {
+		return a.EndedAt.Compare(b.EndedAt)
+	})
+
+	for i := range matches {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(&matches[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matches reports whether a match passes the filter, like query does for
+// Mongo
+func (f MatchFilter) matches(match Match) bool {
+	if f.PlayerID != "" && !slices.ContainsFunc(match.Participants, func(p MatchParticipant) bool {
+		return p.PlayerID == f.PlayerID
+	}) {
+		return false
+	}
+	if f.ConfigKey != "" && match.ConfigKey != f.ConfigKey {
+		return false
+	}
+	if !f.From.IsZero() && match.EndedAt.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !match.EndedAt.Before(f.To) {
+		return false
+	}
+	return true
+}
+
+func (r *memoryMatches) Leaderboard(ctx context.Context, query LeaderboardQuery) ([]LeaderboardEntry, int, error) {
+	entries, err := r.leaderboard(query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ranked := page(entries, query.Offset, query.Limit)
+	if len(ranked) > 0 {
+		rankEntries(ranked, query.Offset, playersAhead(entries, ranked[0].TotalScore))
+	}
+
+	return ranked, len(entries), nil
+}
+
+func (r *memoryMatches) LeaderboardRank(ctx context.Context, query LeaderboardQuery, playerID string) (*LeaderboardEntry, error) {
+	entries, err := r.leaderboard(query)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.PlayerID == playerID {
+			entry.Rank = playersAhead(entries, entry.TotalScore) + 1
+			return &entry, nil
+		}
+	}
+	return nil, nil
+}
+
+// playersAhead counts the entries with a higher total score than score
+func playersAhead(entries []LeaderboardEntry, score int) int {
+	ahead := 0
+	for _, entry := range entries {
+		if entry.TotalScore > score {
+			ahead++
+		}
+	}
+	return ahead
+}
+
+// leaderboard aggregates every ranked account in the window, ordered the
+// same way as leaderboardPipeline
+func (r *memoryMatches) leaderboard(query LeaderboardQuery) ([]LeaderboardEntry, error) {
+	since, err := query.Window.Since(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	matches := make([]Match, 0)
+	for _, match := range r.matches {
+		if match.ConfigKey == query.ConfigKey && !match.EndedAt.Before(since) {
+			matches = append(matches, match)
+		}
+	}
+	r.mu.RUnlock()
+
+	// Oldest first, so the latest name wins
+	slices.SortFunc(matches, func(a, b Match) int {
+		return a.EndedAt.Compare(b.EndedAt)
+	})
+
+	totals := make(map[string]*LeaderboardEntry)
+	for _, match := range matches {
+		for _, participant := range match.Participants {
+			if !participant.IsLoggedIn {
+				continue
+			}
+
+			entry, ok := totals[participant.PlayerID]
+			if !ok {
+				entry = &LeaderboardEntry{PlayerID: participant.PlayerID, BestScore: participant.Score}
+				totals[participant.PlayerID] = entry
+			}
+			entry.PlayerName = participant.PlayerName
+			entry.TotalScore += participant.Score
+			entry.GamesPlayed++
+			entry.BestScore = max(entry.BestScore, participant.Score)
+		}
+	}
+
+	entries := make([]LeaderboardEntry, 0, len(totals))
+	for _, entry := range totals {
+		entries = append(entries, *entry)
+	}
+	slices.SortFunc(entries, func(a, b LeaderboardEntry) int {
+		if a.TotalScore != b.TotalScore {
+			return b.TotalScore - a.TotalScore
+		}
+		return strings.Compare(a.PlayerID, b.PlayerID)
+	})
+
+	return entries, nil
+}
+
+func (r *memoryMatches) Reassign(ctx context.Context, playerID string, to ReplayPlayer, isLoggedIn bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, match := range r.matches {
+		changed := false
+		participants := slices.Clone(match.Participants)
+		for i := range participants {
+			if participants[i].PlayerID == playerID {
+				participants[i].PlayerID = to.PlayerID
+				participants[i].PlayerName = to.PlayerName
+				participants[i].IsLoggedIn = isLoggedIn
+				changed = true
+			}
+		}
+		if changed {
+			match.Participants = participants
+			r.matches[id] = match
+		}
+	}
+	return nil
+}
+
+type memoryReplays struct {
+	mu      sync.RWMutex
+	replays map[primitive.ObjectID]Replay
+}
+
+func (r *memoryReplays) Insert(ctx context.Context, replay *Replay) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.replays[replay.MatchID] = *replay
+	return nil
+}
+
+func (r *memoryReplays) Get(ctx context.Context, matchID string) (*Replay, error) {
+	objectID, err := primitive.ObjectIDFromHex(matchID)
+	if err != nil {
+		return nil, ErrReplayNotFound
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	replay, ok := r.replays[objectID]
+	if !ok {
+		return nil, ErrReplayNotFound
+	}
+	return &replay, nil
+}
+
+func (r *memoryReplays) Reassign(ctx context.Context, playerID string, to ReplayPlayer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, replay := range r.replays {
+		changed := false
+		players := slices.Clone(replay.Players)
+		for i := range players {
+			if players[i].PlayerID == playerID {
+				players[i] = to
+				changed = true
+			}
+		}
+		actions := slices.Clone(replay.Actions)
+		for i := range actions {
+			if actions[i].PlayerID == playerID {
+				actions[i].PlayerID = to.PlayerID
+				changed = true
+			}
+		}
+		if changed {
+			replay.Players = players
+			replay.Actions = actions
+			r.replays[id] = replay
+		}
+	}
+	return nil
+}
+
+type memoryStats struct {
+	mu    sync.RWMutex
+	stats map[string]UserStats
+}
+
+func (r *memoryStats) RecordResult(ctx context.Context, userID string, result MatchParticipant, won bool, duration time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats, ok := r.stats[userID]
+	if !ok {
+		stats = UserStats{UserID: userID, BestScore: result.Score}
+	}
+
+	stats.GamesPlayed++
+	if won {
+		stats.Wins++
+	}
+	stats.TotalReveals += result.Reveals
+	stats.TotalMineHits += result.MineHits
+	stats.TotalFlags += result.Flags
+	stats.CorrectFlags += result.CorrectFlags
+	stats.TotalPlaySeconds += int64(duration.Seconds())
+	stats.BestScore = max(stats.BestScore, result.Score)
+	stats.UpdatedAt = time.Now()
+
+	r.stats[userID] = stats
+	return nil
+}
+
+func (r *memoryStats) Get(ctx context.Context, userID string) (*UserStats, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	stats, ok := r.stats[userID]
+	if !ok {
+		return &UserStats{UserID: userID}, nil
+	}
+	return &stats, nil
+}
+
+func (r *memoryStats) Delete(ctx context.Context, userID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.stats, userID)
+	return nil
+}
+
+type memorySnapshots struct {
+	mu        sync.RWMutex
+	snapshots map[string]RoomSnapshot
+}
+
+func (r *memorySnapshots) Save(ctx context.Context, snapshot *RoomSnapshot) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.snapshots[snapshot.RoomID] = *snapshot
+	return nil
+}
+
+func (r *memorySnapshots) Load(ctx context.Context, roomID string) (*RoomSnapshot, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	snapshot, ok := r.snapshots[roomID]
+	if !ok {
+		return nil, nil
+	}
+	return &snapshot, nil
+}
+
+type memorySessions struct {
+	mu            sync.Mutex
+	sessions      map[string]Session
+	refreshTokens map[string]RefreshToken
+}
+
+func (r *memorySessions) Create(ctx context.Context, session *Session, token *RefreshToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sessions[session.ID] = *session
+	r.refreshTokens[token.Hash] = *token
+	return nil
+}
+
+func (r *memorySessions) Get(ctx context.Context, sessionID string) (*Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	session, ok := r.sessions[sessionID]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return &session, nil
+}
+
+func (r *memorySessions) Rotate(ctx context.Context, hash string, next *RefreshToken) (*RefreshToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	used, ok := r.refreshTokens[hash]
+	if !ok || (used.UsedAt.IsZero() && !now.Before(used.ExpiresAt)) {
+		return nil, ErrRefreshTokenNotFound
+	}
+	if !used.UsedAt.IsZero() {
+		return &used, ErrRefreshTokenReused
+	}
+
+	used.UsedAt = now
+	r.refreshTokens[hash] = used
+
+	next.SessionID = used.SessionID
+	next.UserID = used.UserID
+	r.refreshTokens[next.Hash] = *next
+
+	if session, ok := r.sessions[used.SessionID]; ok {
+		session.ExpiresAt = next.ExpiresAt
+		r.sessions[used.SessionID] = session
+	}
+
+	return &used, nil
+}
+
+func (r *memorySessions) Revoke(ctx context.Context, sessionID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if session, ok := r.sessions[sessionID]; ok && session.RevokedAt.IsZero() {
+		session.RevokedAt = time.Now()
+		r.sessions[sessionID] = session
+	}
+
+	for hash, token := range r.refreshTokens {
+		if token.SessionID == sessionID && token.UsedAt.IsZero() {
+			delete(r.refreshTokens, hash)
+		}
+	}
+	return nil
+}
+
+func (r *memorySessions) RevokeAll(ctx context.Context, userID string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	sessionIDs := make([]string, 0)
+	for id, session := range r.sessions {
+		if session.UserID == userID && session.Active(now) {
+			session.RevokedAt = now
+			r.sessions[id] = session
+			sessionIDs = append(sessionIDs, id)
+		}
+	}
+
+	for hash, token := range r.refreshTokens {
+		if token.UserID == userID && token.UsedAt.IsZero() {
+			delete(r.refreshTokens, hash)
+		}
+	}
+	return sessionIDs, nil
+}
+
+type memoryEmailTokens struct {
+	mu     sync.Mutex
+	tokens map[string]EmailToken
+}
+
+func (r *memoryEmailTokens) Create(ctx context.Context, token *EmailToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for hash, existing := range r.tokens {
+		if existing.UserID == token.UserID && existing.Purpose == token.Purpose {
+			delete(r.tokens, hash)
+		}
+	}
+	r.tokens[token.Hash] = *token
+	return nil
+}
+
+func (r *memoryEmailTokens) Consume(ctx context.Context, hash string, purpose EmailTokenPurpose) (*EmailToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	token, ok := r.tokens[hash]
+	if !ok || token.Purpose != purpose {
+		return nil, ErrEmailTokenNotFound
+	}
+	delete(r.tokens, hash)
+
+	if !time.Now().Before(token.ExpiresAt) {
+		return nil, ErrEmailTokenNotFound
+	}
+	return &token, nil
+}
+
+func (r *memoryEmailTokens) Latest(ctx context.Context, userID string, purpose EmailTokenPurpose) (*EmailToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	var latest *EmailToken
+	for _, token := range r.tokens {
+		if token.UserID != userID || token.Purpose != purpose || !now.Before(token.ExpiresAt) {
+			continue
+		}
+		if latest == nil || token.CreatedAt.After(latest.CreatedAt) {
+			latest = &token
+		}
+	}
+	if latest == nil {
+		return nil, ErrEmailTokenNotFound
+	}
+	return latest, nil
+}
+
+// page returns the items in [offset, offset+limit)
+func page[T any](items []T, offset, limit int) []T {
+	if offset >= len(items) {
+		return []T{}
+	}
+	return items[offset:min(offset+limit, len(items))]
+}
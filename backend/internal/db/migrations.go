@@ -0,0 +1,298 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migration is a versioned change to the database, such as creating an
+// index. Up must be safe to run again if a previous attempt failed halfway.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, database *mongo.Database) error
+}
+
+// MigrationStatus reports whether a migration has been applied
+type MigrationStatus struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"appliedAt"`
+}
+
+// Applied reports whether the migration has run
+func (s MigrationStatus) Applied() bool {
+	return !s.AppliedAt.IsZero()
+}
+
+// migrations must stay in version order. Never edit or renumber a migration
+// once it has been released; add a new one instead.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "index matches by config and by participant",
+		Up: func(ctx context.Context, database *mongo.Database) error {
+			_, err := database.Collection(matchesCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "configKey", Value: 1}, {Key: "endedAt", Value: -1}}},
+				{Keys: bson.D{{Key: "participants.playerID", Value: 1}, {Key: "endedAt", Value: -1}}},
+			})
+			return err
+		},
+	},
+	{
+		Version:     2,
+		Description: "unique usernames and emails",
+		Up: func(ctx context.Context, database *mongo.Database) error {
+			users := database.Collection(usersCollection)
+			// Duplicates would make the index fail with a bare duplicate
+			// key error, so they are listed for an admin to resolve
+			if err := checkUnique(ctx, users, "username"); err != nil {
+				return err
+			}
+			if err := checkUnique(ctx, users, "email"); err != nil {
+				return err
+			}
+
+			_, err := users.Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{
+					Keys:    bson.D{{Key: "username", Value: 1}},
+					Options: options.Index().SetUnique(true),
+				},
+				{
+					// Email is optional, so only non-empty emails must be unique
+					Keys: bson.D{{Key: "email", Value: 1}},
+					Options: options.Index().SetUnique(true).
+						SetPartialFilterExpression(bson.M{"email": bson.M{"$gt": ""}}),
+				},
+			})
+			return err
+		},
+	},
+	{
+		Version:     3,
+		Description: "index matches by end time",
+		Up: func(ctx context.Context, database *mongo.Database) error {
+			_, err := database.Collection(matchesCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "endedAt", Value: -1}},
+			})
+			return err
+		},
+	},
+	{
+		Version:     4,
+		Description: "expire sessions and refresh tokens",
+		Up:          sessionIndexes,
+	},
+	{
+		Version:     5,
+		Description: "expire email tokens",
+		Up:          emailTokenIndexes,
+	},
+	{
+		Version:     6,
+		Description: "unique linked identities",
+		Up: func(ctx context.Context, database *mongo.Database) error {
+			_, err := database.Collection(usersCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "identities.provider", Value: 1}, {Key: "identities.subject", Value: 1}},
+				// Most users have no identities, so only index those that do
+				Options: options.Index().SetUnique(true).
+					SetPartialFilterExpression(bson.M{"identities.subject": bson.M{"$exists": true}}),
+			})
+			return err
+		},
+	},
+	{
+		Version:     7,
+		Description: "index linked identities by a combined key",
+		Up: func(ctx context.Context, database *mongo.Database) error {
+			users := database.Collection(usersCollection)
+
+			// Fill in the key of identities linked before it existed
+			_, err := users.UpdateMany(ctx,
+				bson.M{"identities": bson.M{"$elemMatch": bson.M{"key": bson.M{"$exists": false}}}},
+				mongo.Pipeline{{{Key: "$set", Value: bson.M{
+					"identities": bson.M{"$map": bson.M{
+						"input": "$identities",
+						"in": bson.M{"$mergeObjects": bson.A{"$$this", bson.M{
+							"key": bson.M{"$concat": bson.A{"$$this.provider", ":", "$$this.subject"}},
+						}}},
+					}},
+				}}}},
+			)
+			if err != nil {
+				return err
+			}
+
+			_, err = users.Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "identities.key", Value: 1}},
+				Options: options.Index().SetUnique(true).
+					SetPartialFilterExpression(bson.M{"identities.key": bson.M{"$exists": true}}),
+			})
+			if err != nil {
+				return err
+			}
+
+			// The index from migration 6 pairs every provider of a user with
+			// every subject, rejecting identities nobody has linked
+			_, err = users.Indexes().DropOne(ctx, "identities.provider_1_identities.subject_1")
+			var serverErr mongo.ServerError
+			if errors.As(err, &serverErr) && serverErr.HasErrorCode(indexNotFoundCode) {
+				return nil
+			}
+			return err
+		},
+	},
+}
+
+// indexNotFoundCode is the server error for dropping an index that does
+// not exist, as when a migration is repeated
+const indexNotFoundCode = 27
+
+const migrationsCollection = "schema_migrations"
+
+// maxListedDuplicates caps how many duplicated values checkUnique reports
+const maxListedDuplicates = 20
+
+// checkUnique returns an error listing the documents that share a non-empty
+// value of field, which a unique index on it would reject
+func checkUnique(ctx context.Context, collection *mongo.Collection, field string) error {
+	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{field: bson.M{"$gt": ""}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   "$" + field,
+			"ids":   bson.M{"$push": "$_id"},
+			"count": bson.M{"$sum": 1},
+		}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("checking for duplicate %ss: %w", field, err)
+	}
+
+	var duplicates []struct {
+		Value string               `bson:"_id"`
+		IDs   []primitive.ObjectID `bson:"ids"`
+	}
+	if err := cursor.All(ctx, &duplicates); err != nil {
+		return fmt.Errorf("checking for duplicate %ss: %w", field, err)
+	}
+	if len(duplicates) == 0 {
+		return nil
+	}
+
+	listed := min(len(duplicates), maxListedDuplicates)
+	conflicts := make([]string, 0, listed+1)
+	for _, duplicate := range duplicates[:listed] {
+		ids := make([]string, 0, len(duplicate.IDs))
+		for _, id := range duplicate.IDs {
+			ids = append(ids, id.Hex())
+		}
+		conflicts = append(conflicts, fmt.Sprintf("%q (accounts %s)", duplicate.Value, strings.Join(ids, ", ")))
+	}
+	if len(duplicates) > listed {
+		conflicts = append(conflicts, fmt.Sprintf("and %d more", len(duplicates)-listed))
+	}
+
+	return fmt.Errorf("%d %ss are shared by several accounts; change all but one of each and migrate again: %s",
+		len(duplicates), field, strings.Join(conflicts, "; "))
+}
+
+type mongoMigrator struct {
+	database *mongo.Database
+}
+
+func (m *mongoMigrator) Migrate(ctx context.Context) ([]MigrationStatus, error) {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	collection := m.database.Collection(migrationsCollection)
+	applied := make([]MigrationStatus, 0)
+
+	for i, migration := range migrations {
+		if statuses[i].Applied() {
+			continue
+		}
+
+		if err := migration.Up(ctx, m.database); err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Description, err)
+		}
+
+		status := MigrationStatus{
+			Version:     migration.Version,
+			Description: migration.Description,
+			AppliedAt:   time.Now(),
+		}
+		// Another instance may have applied it at the same time, which is
+		// fine as migrations can be repeated
+		if _, err := collection.InsertOne(ctx, status); err != nil && !mongo.IsDuplicateKeyError(err) {
+			return applied, fmt.Errorf("recording migration %d: %w", migration.Version, err)
+		}
+
+		log.Printf("Applied migration %d: %s", migration.Version, migration.Description)
+		applied = append(applied, status)
+	}
+
+	return applied, nil
+}
+
+func (m *mongoMigrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	cursor, err := m.database.Collection(migrationsCollection).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	var recorded []MigrationStatus
+	if err := cursor.All(ctx, &recorded); err != nil {
+		return nil, err
+	}
+
+	appliedAt := make(map[int]time.Time, len(recorded))
+	for _, status := range recorded {
+		appliedAt[status.Version] = status.AppliedAt
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, migration := range migrations {
+		statuses = append(statuses, MigrationStatus{
+			Version:     migration.Version,
+			Description: migration.Description,
+			AppliedAt:   appliedAt[migration.Version],
+		})
+	}
+
+	return statuses, nil
+}
+
+// memoryMigrator has nothing to migrate; the in-memory store always
+// behaves as if every migration has been applied
+type memoryMigrator struct {
+	openedAt time.Time
+}
+
+func (m *memoryMigrator) Migrate(ctx context.Context) ([]MigrationStatus, error) {
+	return []MigrationStatus{}, nil
+}
+
+func (m *memoryMigrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, migration := range migrations {
+		statuses = append(statuses, MigrationStatus{
+			Version:     migration.Version,
+			Description: migration.Description,
+			AppliedAt:   m.openedAt,
+		})
+	}
+	return statuses, nil
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrReplayNotFound = errors.New("replay not found")
+
+// ReplayAction is an accepted cell action, timed in milliseconds from the
+// start of the round
+type ReplayAction struct {
+	At       int64  `bson:"at" json:"at"`
+	Type     string `bson:"type" json:"type"`
+	X        int    `bson:"x" json:"x"`
+	Y        int    `bson:"y" json:"y"`
+	PlayerID string `bson:"playerID" json:"playerID"`
+}
+
+type ReplayPlayer struct {
+	PlayerID   string `bson:"playerID" json:"playerID"`
+	PlayerName string `bson:"playerName" json:"playerName"`
+}
+
+// Replay is the ordered action log of a round. Together with the initial
+// mine layout it is enough to re-simulate the round to any point.
+type Replay struct {
+	MatchID primitive.ObjectID `bson:"_id" json:"matchID"`
+	Config  BoardConfig        `bson:"config" json:"config"`
+	Mines   [][2]int           `bson:"mines" json:"mines"`
+	// Revealed lists the cells a loaded board started with revealed
+	Revealed  [][2]int       `bson:"revealed,omitempty" json:"revealed,omitempty"`
+	StartedAt time.Time      `bson:"startedAt" json:"startedAt"`
+	Duration  int64          `bson:"duration" json:"duration"`
+	Players   []ReplayPlayer `bson:"players" json:"players"`
+	Actions   []ReplayAction `bson:"actions" json:"actions"`
+}
+
+const replaysCollection = "replays"
+
+type mongoReplays struct {
+	collection *mongo.Collection
+}
+
+func (r *mongoReplays) Insert(ctx context.Context, replay *Replay) error {
+	_, err := r.collection.InsertOne(ctx, replay)
+	return err
+}
+
+func (r *mongoReplays) Get(ctx context.Context, matchID string) (*Replay, error) {
+	objectID, err := primitive.ObjectIDFromHex(matchID)
+	if err != nil {
+		return nil, ErrReplayNotFound
+	}
+
+	var replay Replay
+	err = r.collection.FindOne(ctx, bson.M{"_id": objectID}).Decode(&replay)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrReplayNotFound
+		}
+		return nil, err
+	}
+
+	return &replay, nil
+}
+
+func (r *mongoReplays) Reassign(ctx context.Context, playerID string, to ReplayPlayer) error {
+	_, err := r.collection.UpdateMany(ctx,
+		bson.M{"$or": bson.A{
+			bson.M{"players.playerID": playerID},
+			bson.M{"actions.playerID": playerID},
+		}},
+		bson.M{"$set": bson.M{
+			"players.$[player].playerID":   to.PlayerID,
+			"players.$[player].playerName": to.PlayerName,
+			"actions.$[action].playerID":   to.PlayerID,
+		}},
+		options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{
+			bson.M{"player.playerID": playerID},
+			bson.M{"action.playerID": playerID},
+		}}),
+	)
+	return err
+}
@@ -0,0 +1,173 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrSessionNotFound      = errors.New("session not found")
+	ErrRefreshTokenNotFound = errors.New("refresh token not found")
+	// ErrRefreshTokenReused means a refresh token was presented after it had
+	// already been rotated, which suggests it was stolen
+	ErrRefreshTokenReused = errors.New("refresh token already used")
+)
+
+// Session is a login on one device. Access and refresh tokens belong to a
+// session, and revoking it invalidates all of them.
+type Session struct {
+	ID        string    `bson:"_id"`
+	UserID    string    `bson:"userID"`
+	CreatedAt time.Time `bson:"createdAt"`
+	// ExpiresAt moves forward every time the refresh token is rotated
+	ExpiresAt time.Time `bson:"expiresAt"`
+	RevokedAt time.Time `bson:"revokedAt,omitempty"`
+}
+
+// Active reports whether the session can still be used
+func (s *Session) Active(now time.Time) bool {
+	return s.RevokedAt.IsZero() && now.Before(s.ExpiresAt)
+}
+
+// RefreshToken is a single-use token that is exchanged for a new access
+// token and a new refresh token. Only a hash of the token is stored.
+type RefreshToken struct {
+	Hash      string    `bson:"_id"`
+	SessionID string    `bson:"sessionID"`
+	UserID    string    `bson:"userID"`
+	CreatedAt time.Time `bson:"createdAt"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+	UsedAt    time.Time `bson:"usedAt,omitempty"`
+}
+
+const (
+	sessionsCollection      = "sessions"
+	refreshTokensCollection = "refresh_tokens"
+)
+
+type mongoSessions struct {
+	sessions      *mongo.Collection
+	refreshTokens *mongo.Collection
+}
+
+func (r *mongoSessions) Create(ctx context.Context, session *Session, token *RefreshToken) error {
+	if _, err := r.sessions.InsertOne(ctx, session); err != nil {
+		return err
+	}
+
+	_, err := r.refreshTokens.InsertOne(ctx, token)
+	return err
+}
+
+func (r *mongoSessions) Get(ctx context.Context, sessionID string) (*Session, error) {
+	var session Session
+	err := r.sessions.FindOne(ctx, bson.M{"_id": sessionID}).Decode(&session)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrSessionNotFound
+		}
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+func (r *mongoSessions) Rotate(ctx context.Context, hash string, next *RefreshToken) (*RefreshToken, error) {
+	now := time.Now()
+
+	// Marking the token used and checking it was unused is one operation,
+	// so two concurrent refreshes cannot both succeed
+	var used RefreshToken
+	err := r.refreshTokens.FindOneAndUpdate(ctx,
+		bson.M{"_id": hash, "usedAt": bson.M{"$exists": false}, "expiresAt": bson.M{"$gt": now}},
+		bson.M{"$set": bson.M{"usedAt": now}},
+	).Decode(&used)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		var existing RefreshToken
+		err := r.refreshTokens.FindOne(ctx, bson.M{"_id": hash}).Decode(&existing)
+		if errors.Is(err, mongo.ErrNoDocuments) || (err == nil && existing.UsedAt.IsZero()) {
+			return nil, ErrRefreshTokenNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &existing, ErrRefreshTokenReused
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	next.SessionID = used.SessionID
+	next.UserID = used.UserID
+	if _, err := r.refreshTokens.InsertOne(ctx, next); err != nil {
+		return nil, err
+	}
+
+	_, err = r.sessions.UpdateByID(ctx, used.SessionID, bson.M{"$set": bson.M{"expiresAt": next.ExpiresAt}})
+	return &used, err
+}
+
+func (r *mongoSessions) Revoke(ctx context.Context, sessionID string) error {
+	now := time.Now()
+
+	_, err := r.sessions.UpdateOne(ctx,
+		bson.M{"_id": sessionID, "revokedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revokedAt": now}},
+	)
+	if err != nil {
+		return err
+	}
+
+	// Unused refresh tokens are no longer needed
+	_, err = r.refreshTokens.DeleteMany(ctx, bson.M{"sessionID": sessionID, "usedAt": bson.M{"$exists": false}})
+	return err
+}
+
+func (r *mongoSessions) RevokeAll(ctx context.Context, userID string) ([]string, error) {
+	now := time.Now()
+	active := bson.M{"userID": userID, "revokedAt": bson.M{"$exists": false}, "expiresAt": bson.M{"$gt": now}}
+
+	cursor, err := r.sessions.Find(ctx, active, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var sessions []Session
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+
+	sessionIDs := make([]string, 0, len(sessions))
+	for _, session := range sessions {
+		sessionIDs = append(sessionIDs, session.ID)
+	}
+
+	if _, err := r.sessions.UpdateMany(ctx, active, bson.M{"$set": bson.M{"revokedAt": now}}); err != nil {
+		return nil, err
+	}
+
+	_, err = r.refreshTokens.DeleteMany(ctx, bson.M{"userID": userID, "usedAt": bson.M{"$exists": false}})
+	return sessionIDs, err
+}
+
+// sessionIndexes expire sessions and refresh tokens once they can no longer
+// be used, and look up a session's refresh tokens
+func sessionIndexes(ctx context.Context, database *mongo.Database) error {
+	_, err := database.Collection(sessionsCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "userID", Value: 1}}},
+		{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = database.Collection(refreshTokensCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "sessionID", Value: 1}}},
+		{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	return err
+}
@@ -0,0 +1,77 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type SnapshotFlag struct {
+	X       int    `bson:"x"`
+	Y       int    `bson:"y"`
+	OwnerID string `bson:"ownerID"`
+}
+
+type SnapshotPlayer struct {
+	PlayerID        string `bson:"playerID"`
+	PlayerName      string `bson:"playerName"`
+	IsLoggedIn      bool   `bson:"isLoggedIn"`
+	Score           int    `bson:"score"`
+	TotalReveals    int    `bson:"totalReveals"`
+	TotalMineHits   int    `bson:"totalMineHits"`
+	ActiveFlagCount int    `bson:"activeFlagCount"`
+	// PlayTime is how long the player was in the round so far, in
+	// milliseconds
+	PlayTime int64 `bson:"playTime,omitempty"`
+}
+
+// RoomSnapshot is the state of a room's current round, saved so the round
+// survives a server restart. The board is stored as its mine layout plus
+// the revealed and flagged cells.
+type RoomSnapshot struct {
+	RoomID      string           `bson:"_id"`
+	Seed        int64            `bson:"seed"`
+	StartedAt   time.Time        `bson:"startedAt"`
+	GameStatus  int              `bson:"gameStatus"`
+	RestartTime int64            `bson:"restartTime"`
+	Mines       [][2]int         `bson:"mines"`
+	Revealed    [][2]int         `bson:"revealed"`
+	Flags       []SnapshotFlag   `bson:"flags"`
+	Players     []SnapshotPlayer `bson:"players"`
+	Actions     []ReplayAction   `bson:"actions"`
+	// InitialRevealed lists the cells a loaded board started with revealed
+	InitialRevealed [][2]int  `bson:"initialRevealed,omitempty"`
+	SavedAt         time.Time `bson:"savedAt"`
+}
+
+const snapshotsCollection = "room_snapshots"
+
+type mongoSnapshots struct {
+	collection *mongo.Collection
+}
+
+func (r *mongoSnapshots) Save(ctx context.Context, snapshot *RoomSnapshot) error {
+	_, err := r.collection.ReplaceOne(ctx,
+		bson.M{"_id": snapshot.RoomID},
+		snapshot,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+func (r *mongoSnapshots) Load(ctx context.Context, roomID string) (*RoomSnapshot, error) {
+	var snapshot RoomSnapshot
+	err := r.collection.FindOne(ctx, bson.M{"_id": roomID}).Decode(&snapshot)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &snapshot, nil
+}
@@ -0,0 +1,87 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// UserStats are the lifetime totals of an account across finished rounds
+type UserStats struct {
+	UserID           string    `bson:"_id" json:"userID"`
+	GamesPlayed      int       `bson:"gamesPlayed" json:"gamesPlayed"`
+	Wins             int       `bson:"wins" json:"wins"`
+	BestScore        int       `bson:"bestScore" json:"bestScore"`
+	TotalReveals     int       `bson:"totalReveals" json:"totalReveals"`
+	TotalMineHits    int       `bson:"totalMineHits" json:"totalMineHits"`
+	TotalFlags       int       `bson:"totalFlags" json:"totalFlags"`
+	CorrectFlags     int       `bson:"correctFlags" json:"correctFlags"`
+	TotalPlaySeconds int64     `bson:"totalPlaySeconds" json:"totalPlaySeconds"`
+	UpdatedAt        time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+// FlagAccuracy is the share of flags that were placed on mines
+func (s *UserStats) FlagAccuracy() float64 {
+	if s.TotalFlags == 0 {
+		return 0
+	}
+	return float64(s.CorrectFlags) / float64(s.TotalFlags)
+}
+
+// AverageSeconds is the average round length in seconds
+func (s *UserStats) AverageSeconds() float64 {
+	if s.GamesPlayed == 0 {
+		return 0
+	}
+	return float64(s.TotalPlaySeconds) / float64(s.GamesPlayed)
+}
+
+const statsCollection = "user_stats"
+
+type mongoStats struct {
+	collection *mongo.Collection
+}
+
+func (r *mongoStats) RecordResult(ctx context.Context, userID string, result MatchParticipant, won bool, duration time.Duration) error {
+	wins := 0
+	if won {
+		wins = 1
+	}
+
+	update := bson.M{
+		"$inc": bson.M{
+			"gamesPlayed":      1,
+			"wins":             wins,
+			"totalReveals":     result.Reveals,
+			"totalMineHits":    result.MineHits,
+			"totalFlags":       result.Flags,
+			"correctFlags":     result.CorrectFlags,
+			"totalPlaySeconds": int64(duration.Seconds()),
+		},
+		"$max": bson.M{"bestScore": result.Score},
+		"$set": bson.M{"updatedAt": time.Now()},
+	}
+
+	_, err := r.collection.UpdateByID(ctx, userID, update, options.Update().SetUpsert(true))
+	return err
+}
+
+func (r *mongoStats) Get(ctx context.Context, userID string) (*UserStats, error) {
+	stats := &UserStats{UserID: userID}
+
+	err := r.collection.FindOne(ctx, bson.M{"_id": userID}).Decode(stats)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+func (r *mongoStats) Delete(ctx context.Context, userID string) error {
+	_, err := r.collection.DeleteOne(ctx, bson.M{"_id": userID})
+	return err
+}
@@ -0,0 +1,165 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Store groups the repositories the server persists its data through
+type Store struct {
+	Users     UserRepository
+	Matches   MatchRepository
+	Replays   ReplayRepository
+	Stats     StatsRepository
+	Snapshots SnapshotRepository
+	Sessions  SessionRepository
+
+	EmailTokens EmailTokenRepository
+
+	Migrations Migrator
+
+	close func() error
+}
+
+// Close releases the store's connection, if it has one
+func (s *Store) Close() error {
+	if s.close != nil {
+		return s.close()
+	}
+	return nil
+}
+
+type Migrator interface {
+	// Migrate applies every pending migration in version order and returns
+	// the ones it applied
+	Migrate(ctx context.Context) ([]MigrationStatus, error)
+	// Status lists every known migration and when it was applied
+	Status(ctx context.Context) ([]MigrationStatus, error)
+}
+
+type UserRepository interface {
+	// Create stores a new user, returning ErrIdentityExists if one of its
+	// identities is linked to another user, or ErrUserExists if the
+	// username or email is taken
+	Create(ctx context.Context, user *User) error
+	// GetByUsername and GetByID return ErrUserNotFound if there is no such
+	// user
+	GetByUsername(ctx context.Context, username string) (*User, error)
+	GetByID(ctx context.Context, userID string) (*User, error)
+	// GetByEmail returns ErrUserNotFound if no user has the email
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	// GetByIdentity returns the user an external login is linked to, or
+	// ErrUserNotFound
+	GetByIdentity(ctx context.Context, provider, subject string) (*User, error)
+	// Update replaces a stored user, returning ErrUserNotFound if it does
+	// not exist, ErrIdentityExists if a new identity is linked to another
+	// user, or ErrUserExists if its new email is taken
+	Update(ctx context.Context, user *User) error
+	// Delete removes a user, returning ErrUserNotFound if it does not exist
+	Delete(ctx context.Context, userID string) error
+}
+
+type MatchRepository interface {
+	Insert(ctx context.Context, match *Match) error
+	// Get returns ErrMatchNotFound if there is no such match
+	Get(ctx context.Context, matchID string) (*Match, error)
+	// List returns one page of matches, newest first, without their board
+	// layouts, along with the total number of matches for the filter
+	List(ctx context.Context, filter MatchFilter) ([]Match, int, error)
+	// Each calls fn for every match passing the filter, oldest first,
+	// without their board layouts. Offset and Limit are ignored. Matches
+	// are streamed, so fn may be called long after Each starts. It stops
+	// at the first error fn returns.
+	Each(ctx context.Context, filter MatchFilter, fn func(*Match) error) error
+	// Leaderboard returns one page of the leaderboard and the total number
+	// of ranked accounts
+	Leaderboard(ctx context.Context, query LeaderboardQuery) ([]LeaderboardEntry, int, error)
+	// LeaderboardRank returns an account's own entry, or nil if it has no
+	// rounds in the window. Accounts with equal totals share a rank.
+	LeaderboardRank(ctx context.Context, query LeaderboardQuery, playerID string) (*LeaderboardEntry, error)
+	// Reassign replaces a player in every match they took part in with
+	// another identity, such as an account a guest signed up for or an
+	// anonymous stand-in for a deleted account
+	Reassign(ctx context.Context, playerID string, to ReplayPlayer, isLoggedIn bool) error
+}
+
+type SessionRepository interface {
+	// Create stores a new session along with its first refresh token
+	Create(ctx context.Context, session *Session, token *RefreshToken) error
+	// Get returns ErrSessionNotFound if there is no such session
+	Get(ctx context.Context, sessionID string) (*Session, error)
+	// Rotate marks the unexpired refresh token with the given hash as used
+	// and stores next in the same session, returning the used token. If the
+	// token was already used it returns the token with
+	// ErrRefreshTokenReused; if it does not exist or has expired,
+	// ErrRefreshTokenNotFound.
+	Rotate(ctx context.Context, hash string, next *RefreshToken) (*RefreshToken, error)
+	// Revoke ends a session, invalidating its access and refresh tokens
+	Revoke(ctx context.Context, sessionID string) error
+	// RevokeAll ends every active session of a user and returns their IDs
+	RevokeAll(ctx context.Context, userID string) ([]string, error)
+}
+
+type EmailTokenRepository interface {
+	// Create stores a new token, replacing any earlier token the user has
+	// for the same purpose
+	Create(ctx context.Context, token *EmailToken) error
+	// Consume deletes and returns the unexpired token with the given hash
+	// and purpose, or returns ErrEmailTokenNotFound
+	Consume(ctx context.Context, hash string, purpose EmailTokenPurpose) (*EmailToken, error)
+	// Latest returns the user's unexpired token for a purpose, or returns
+	// ErrEmailTokenNotFound
+	Latest(ctx context.Context, userID string, purpose EmailTokenPurpose) (*EmailToken, error)
+}
+
+type ReplayRepository interface {
+	Insert(ctx context.Context, replay *Replay) error
+	// Get returns ErrReplayNotFound if the match has no replay
+	Get(ctx context.Context, matchID string) (*Replay, error)
+	// Reassign replaces a player in every replay they appear in
+	Reassign(ctx context.Context, playerID string, to ReplayPlayer) error
+}
+
+type StatsRepository interface {
+	// RecordResult adds a finished round to a user's lifetime stats
+	RecordResult(ctx context.Context, userID string, result MatchParticipant, won bool, duration time.Duration) error
+	// Get returns a user's stats, or empty stats if they have not finished
+	// a round yet
+	Get(ctx context.Context, userID string) (*UserStats, error)
+	// Delete removes a user's stats
+	Delete(ctx context.Context, userID string) error
+}
+
+type SnapshotRepository interface {
+	// Save replaces the stored snapshot of a room
+	Save(ctx context.Context, snapshot *RoomSnapshot) error
+	// Load returns the stored snapshot of a room, or nil if there is none
+	Load(ctx context.Context, roomID string) (*RoomSnapshot, error)
+}
+
+// DeletedPlayerName replaces the name of a deleted account in match history
+const DeletedPlayerName = "Deleted player"
+
+// NewAnonymousPlayer returns a new ID and name to replace a deleted account
+// with, that cannot be traced back to the account
+func NewAnonymousPlayer() ReplayPlayer {
+	return ReplayPlayer{
+		PlayerID:   "deleted-" + primitive.NewObjectID().Hex(),
+		PlayerName: DeletedPlayerName,
+	}
+}
+
+// AnonymizeUser removes a user from their match history, replays and stats
+// so the account can be deleted. The user's results stay in the matches they
+// played under the anonymous player.
+func (s *Store) AnonymizeUser(ctx context.Context, userID string, anonymous ReplayPlayer) error {
+	if err := s.Matches.Reassign(ctx, userID, anonymous, false); err != nil {
+		return err
+	}
+	if err := s.Replays.Reassign(ctx, userID, anonymous); err != nil {
+		return err
+	}
+	return s.Stats.Delete(ctx, userID)
+}
@@ -0,0 +1,225 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("user already exists")
+	// ErrIdentityExists means an external login is already linked to
+	// another user
+	ErrIdentityExists = errors.New("identity is linked to another user")
+)
+
+type User struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Username      string             `bson:"username" json:"username"`
+	DisplayName   string             `bson:"displayName,omitempty" json:"displayName,omitempty"`
+	Email         string             `bson:"email" json:"email"`
+	EmailVerified bool               `bson:"emailVerified" json:"emailVerified"`
+	Password      string             `bson:"password" json:"-"`
+	Role          Role               `bson:"role,omitempty" json:"role,omitempty"`
+	Identities    []Identity         `bson:"identities,omitempty" json:"identities,omitempty"`
+	CreatedAt     time.Time          `bson:"createdAt" json:"createdAt"`
+	UpdatedAt     time.Time          `bson:"updatedAt" json:"updatedAt"`
+}
+
+// Role decides what a user may do beyond playing. Each role can do
+// everything the roles below it can; an empty role is a player.
+type Role string
+
+const (
+	RolePlayer    Role = "player"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+// roleRanks orders the roles from least to most privileged
+var roleRanks = map[Role]int{
+	"":            0,
+	RolePlayer:    0,
+	RoleModerator: 1,
+	RoleAdmin:     2,
+}
+
+// Valid reports whether r is one of the known roles
+func (r Role) Valid() bool {
+	_, ok := roleRanks[r]
+	return ok && r != ""
+}
+
+// Includes reports whether a user with role r may do what required allows.
+// Unknown roles neither include nor are included by anything.
+func (r Role) Includes(required Role) bool {
+	rank, ok := roleRanks[r]
+	requiredRank, requiredOK := roleRanks[required]
+	return ok && requiredOK && rank >= requiredRank
+}
+
+// Identity is an account at an external login provider linked to a user.
+// Subject is the provider's stable ID for that account.
+type Identity struct {
+	Provider string `bson:"provider" json:"provider"`
+	Subject  string `bson:"subject" json:"-"`
+	// Key combines Provider and Subject for the unique index. It is filled
+	// in when the user is stored.
+	Key      string    `bson:"key" json:"-"`
+	Email    string    `bson:"email,omitempty" json:"email,omitempty"`
+	LinkedAt time.Time `bson:"linkedAt" json:"linkedAt"`
+}
+
+// identityKey is the value identities are indexed by. Indexing provider and
+// subject as separate fields of the array would pair every provider with
+// every subject of a user, and so reject identities nobody has linked.
+func identityKey(provider, subject string) string {
+	return provider + ":" + subject
+}
+
+// prepareUser fills in the generated fields of a user about to be stored
+func prepareUser(user *User) {
+	for i := range user.Identities {
+		user.Identities[i].Key = identityKey(user.Identities[i].Provider, user.Identities[i].Subject)
+	}
+}
+
+// duplicateKeyError maps a duplicate key error on the users collection to
+// the conflict it reports
+func duplicateKeyError(err error) error {
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) && serverErr.HasErrorCodeWithMessage(11000, "identities.key") {
+		return ErrIdentityExists
+	}
+	return ErrUserExists
+}
+
+// Name returns the name to show for the user: the display name if they
+// chose one, otherwise the username
+func (u *User) Name() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	return u.Username
+}
+
+// HasIdentity reports whether an external login is linked to the user
+func (u *User) HasIdentity(provider, subject string) bool {
+	for _, identity := range u.Identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			return true
+		}
+	}
+	return false
+}
+
+const usersCollection = "users"
+
+type mongoUsers struct {
+	collection *mongo.Collection
+}
+
+func (r *mongoUsers) Create(ctx context.Context, user *User) error {
+	prepareUser(user)
+
+	// Usernames, emails and identities have unique indexes, see migrations
+	_, err := r.collection.InsertOne(ctx, user)
+	if mongo.IsDuplicateKeyError(err) {
+		return duplicateKeyError(err)
+	}
+	return err
+}
+
+func (r *mongoUsers) GetByUsername(ctx context.Context, username string) (*User, error) {
+	var user User
+	err := r.collection.FindOne(ctx, bson.M{"username": username}).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (r *mongoUsers) GetByEmail(ctx context.Context, email string) (*User, error) {
+	var user User
+	err := r.collection.FindOne(ctx, bson.M{"email": email}).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (r *mongoUsers) GetByIdentity(ctx context.Context, provider, subject string) (*User, error) {
+	var user User
+	err := r.collection.FindOne(ctx, bson.M{"identities.key": identityKey(provider, subject)}).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (r *mongoUsers) GetByID(ctx context.Context, userID string) (*User, error) {
+	objectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, ErrUserNotFound
+	}
+
+	var user User
+	err = r.collection.FindOne(ctx, bson.M{"_id": objectID}).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (r *mongoUsers) Update(ctx context.Context, user *User) error {
+	prepareUser(user)
+
+	result, err := r.collection.ReplaceOne(ctx, bson.M{"_id": user.ID}, user)
+	if mongo.IsDuplicateKeyError(err) {
+		return duplicateKeyError(err)
+	}
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (r *mongoUsers) Delete(ctx context.Context, userID string) error {
+	objectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return ErrUserNotFound
+	}
+
+	result, err := r.collection.DeleteOne(ctx, bson.M{"_id": objectID})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
@@ -0,0 +1,346 @@
+package export
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/db"
+)
+
+// Dataset selects what an export contains. Every dataset is flat, one row
+// per match, per player result or per action, so it loads straight into a
+// spreadsheet or dataframe.
+type Dataset string
+
+const (
+	DatasetMatches Dataset = "matches"
+	DatasetResults Dataset = "results"
+	DatasetActions Dataset = "actions"
+)
+
+type Format string
+
+const (
+	FormatCSV    Format = "csv"
+	FormatNDJSON Format = "ndjson"
+)
+
+// flushEvery is how many matches are written between flushes of the
+// underlying writer
+const flushEvery = 100
+
+var (
+	ErrInvalidDataset = errors.New("dataset must be matches, results or actions")
+	ErrInvalidFormat  = errors.New("format must be csv or ndjson")
+)
+
+type Options struct {
+	Dataset Dataset
+	Format  Format
+	// From and To bound the end time of exported matches. Zero values are
+	// ignored.
+	From      time.Time
+	To        time.Time
+	ConfigKey string
+}
+
+// Validate checks the dataset and format
+func (o Options) Validate() error {
+	switch o.Dataset {
+	case DatasetMatches, DatasetResults, DatasetActions:
+	default:
+		return ErrInvalidDataset
+	}
+
+	switch o.Format {
+	case FormatCSV, FormatNDJSON:
+	default:
+		return ErrInvalidFormat
+	}
+
+	return nil
+}
+
+// ContentType returns the MIME type of the format
+func (f Format) ContentType() string {
+	if f == FormatCSV {
+		return "text/csv; charset=utf-8"
+	}
+	return "application/x-ndjson"
+}
+
+// row is one exported record
+type row interface {
+	record() []string
+}
+
+type MatchRow struct {
+	MatchID          string    `json:"matchID"`
+	Config           string    `json:"config"`
+	Seed             int64     `json:"seed"`
+	StartedAt        time.Time `json:"startedAt"`
+	EndedAt          time.Time `json:"endedAt"`
+	DurationSeconds  int64     `json:"durationSeconds"`
+	ParticipantCount int       `json:"participantCount"`
+}
+
+var matchHeader = []string{"match_id", "config", "seed", "started_at", "ended_at", "duration_seconds", "participant_count"}
+
+func (r MatchRow) record() []string {
+	return []string{
+		r.MatchID,
+		r.Config,
+		strconv.FormatInt(r.Seed, 10),
+		r.StartedAt.UTC().Format(time.RFC3339),
+		r.EndedAt.UTC().Format(time.RFC3339),
+		strconv.FormatInt(r.DurationSeconds, 10),
+		strconv.Itoa(r.ParticipantCount),
+	}
+}
+
+type ResultRow struct {
+	MatchID      string    `json:"matchID"`
+	Config       string    `json:"config"`
+	EndedAt      time.Time `json:"endedAt"`
+	PlayerID     string    `json:"playerID"`
+	PlayerName   string    `json:"playerName"`
+	IsLoggedIn   bool      `json:"isLoggedIn"`
+	Score        int       `json:"score"`
+	Reveals      int       `json:"reveals"`
+	MineHits     int       `json:"mineHits"`
+	Flags        int       `json:"flags"`
+	CorrectFlags int       `json:"correctFlags"`
+}
+
+var resultHeader = []string{"match_id", "config", "ended_at", "player_id", "player_name", "logged_in", "score", "reveals", "mine_hits", "flags", "correct_flags"}
+
+func (r ResultRow) record() []string {
+	return []string{
+		r.MatchID,
+		r.Config,
+		r.EndedAt.UTC().Format(time.RFC3339),
+		r.PlayerID,
+		r.PlayerName,
+		strconv.FormatBool(r.IsLoggedIn),
+		strconv.Itoa(r.Score),
+		strconv.Itoa(r.Reveals),
+		strconv.Itoa(r.MineHits),
+		strconv.Itoa(r.Flags),
+		strconv.Itoa(r.CorrectFlags),
+	}
+}
+
+type ActionRow struct {
+	MatchID  string `json:"matchID"`
+	Sequence int    `json:"sequence"`
+	// At is milliseconds since the start of the round
+	At       int64  `json:"at"`
+	Type     string `json:"type"`
+	X        int    `json:"x"`
+	Y        int    `json:"y"`
+	PlayerID string `json:"playerID"`
+}
+
+var actionHeader = []string{"match_id", "sequence", "at_ms", "type", "x", "y", "player_id"}
+
+func (r ActionRow) record() []string {
+	return []string{
+		r.MatchID,
+		strconv.Itoa(r.Sequence),
+		strconv.FormatInt(r.At, 10),
+		r.Type,
+		strconv.Itoa(r.X),
+		strconv.Itoa(r.Y),
+		r.PlayerID,
+	}
+}
+
+// encoder writes rows in one format
+type encoder interface {
+	encode(row row) error
+	flush() error
+}
+
+type csvEncoder struct {
+	w *csv.Writer
+}
+
+func (e *csvEncoder) encode(row row) error {
+	return e.w.Write(row.record())
+}
+
+func (e *csvEncoder) flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type ndjsonEncoder struct {
+	enc *json.Encoder
+}
+
+func (e *ndjsonEncoder) encode(row row) error {
+	return e.enc.Encode(row)
+}
+
+func (e *ndjsonEncoder) flush() error {
+	return nil
+}
+
+// Write streams the export to w, one match at a time, so memory use does
+// not grow with the size of the export. If w has a Flush method, such as
+// an http.ResponseWriter, it is flushed periodically.
+func Write(ctx context.Context, w io.Writer, store *db.Store, options Options) error {
+	if err := options.Validate(); err != nil {
+		return err
+	}
+
+	var enc encoder
+	if options.Format == FormatCSV {
+		csvWriter := csv.NewWriter(w)
+		if err := csvWriter.Write(header(options.Dataset)); err != nil {
+			return err
+		}
+		enc = &csvEncoder{w: csvWriter}
+	} else {
+		enc = &ndjsonEncoder{enc: json.NewEncoder(w)}
+	}
+
+	flusher, _ := w.(interface{ Flush() })
+	written := 0
+
+	err := store.Matches.Each(ctx, db.MatchFilter{
+		From:      options.From,
+		To:        options.To,
+		ConfigKey: options.ConfigKey,
+	}, func(match *db.Match) error {
+		if err := writeMatch(ctx, enc, store, options.Dataset, match); err != nil {
+			return err
+		}
+
+		written++
+		if written%flushEvery == 0 {
+			if err := enc.flush(); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return enc.flush()
+}
+
+func header(dataset Dataset) []string {
+	switch dataset {
+	case DatasetResults:
+		return resultHeader
+	case DatasetActions:
+		return actionHeader
+	default:
+		return matchHeader
+	}
+}
+
+func writeMatch(ctx context.Context, enc encoder, store *db.Store, dataset Dataset, match *db.Match) error {
+	matchID := match.ID.Hex()
+
+	switch dataset {
+	case DatasetMatches:
+		return enc.encode(MatchRow{
+			MatchID:          matchID,
+			Config:           match.ConfigKey,
+			Seed:             match.Seed,
+			StartedAt:        match.StartedAt,
+			EndedAt:          match.EndedAt,
+			DurationSeconds:  int64(match.EndedAt.Sub(match.StartedAt).Seconds()),
+			ParticipantCount: len(match.Participants),
+		})
+
+	case DatasetResults:
+		for _, participant := range match.Participants {
+			err := enc.encode(ResultRow{
+				MatchID:      matchID,
+				Config:       match.ConfigKey,
+				EndedAt:      match.EndedAt,
+				PlayerID:     participant.PlayerID,
+				PlayerName:   participant.PlayerName,
+				IsLoggedIn:   participant.IsLoggedIn,
+				Score:        participant.Score,
+				Reveals:      participant.Reveals,
+				MineHits:     participant.MineHits,
+				Flags:        participant.Flags,
+				CorrectFlags: participant.CorrectFlags,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+	case DatasetActions:
+		replay, err := store.Replays.Get(ctx, matchID)
+		if errors.Is(err, db.ErrReplayNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for i, action := range replay.Actions {
+			err := enc.encode(ActionRow{
+				MatchID:  matchID,
+				Sequence: i,
+				At:       action.At,
+				Type:     action.Type,
+				X:        action.X,
+				Y:        action.Y,
+				PlayerID: action.PlayerID,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ParseDateRange parses the bounds of an export, each either RFC 3339 or
+// YYYY-MM-DD. Empty bounds are left zero. A bare date for to includes that
+// whole day.
+func ParseDateRange(fromValue, toValue string) (from, to time.Time, err error) {
+	if fromValue != "" {
+		if from, _, err = parseDate(fromValue); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+
+	if toValue != "" {
+		var dateOnly bool
+		if to, dateOnly, err = parseDate(toValue); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		if dateOnly {
+			to = to.AddDate(0, 0, 1)
+		}
+	}
+
+	return from, to, nil
+}
+
+func parseDate(value string) (t time.Time, dateOnly bool, err error) {
+	if t, err = time.Parse(time.DateOnly, value); err == nil {
+		return t, true, nil
+	}
+	t, err = time.Parse(time.RFC3339, value)
+	return t, false, err
+}
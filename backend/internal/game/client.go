@@ -1,10 +1,11 @@
 package game
 
 import (
-	"encoding/json"
 	"log"
 	"time"
 
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/metrics"
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/ratelimit"
 	"github.com/gorilla/websocket"
 )
 
@@ -14,6 +15,33 @@ const (
 	pingPeriod = (pongWait * 9) / 10
 )
 
+// CloseSessionRevoked is the close code sent to clients whose login was
+// revoked, telling them not to reconnect with the same token
+const CloseSessionRevoked = 4001
+
+func NewClient(hub *GameHub, conn *websocket.Conn, codec Codec, playerID, remoteIP string) *Client {
+	return &Client{
+		Hub:      hub,
+		Conn:     conn,
+		Codec:    codec,
+		PlayerID: playerID,
+		queue:    newSendQueue(hub.Config.SendQueueSize),
+
+		actionLimiter: ratelimit.NewBucket(hub.Config.ActionRate, hub.Config.ActionBurst),
+		remoteIP:      remoteIP,
+	}
+}
+
+// EnableCompression turns on permessage-deflate for messages above the
+// configured threshold. It must only be called if the client negotiated
+// the extension.
+func (c *Client) EnableCompression() {
+	c.compress = true
+	if err := c.Conn.SetCompressionLevel(c.Hub.Config.CompressionLevel); err != nil {
+		log.Printf("Failed to set compression level for player %s: %v", c.currentPlayerID(), err)
+	}
+}
+
 func (c *Client) ReadPump() {
 	defer func() {
 		c.Hub.Unregister <- c
@@ -34,23 +62,71 @@ func (c *Client) ReadPump() {
 			break
 		}
 
+		if !c.allowAction() {
+			metrics.RateLimitedActions.Add(1)
+			if c.recordViolation() {
+				metrics.RateLimitDisconnects.Add(1)
+				log.Printf("ReadPump: disconnecting player %s for exceeding the action rate limit", c.currentPlayerID())
+				c.Conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rate limit exceeded"),
+					time.Now().Add(writeWait))
+				break
+			}
+			continue
+		}
+
 		var cellAction CellAction
 
-		if err := json.Unmarshal(message, &cellAction); err != nil {
-			log.Printf("ReadPump: failed to unmarshal cell action from player %s: %v", c.PlayerID, err)
+		if err := c.Codec.Decode(message, &cellAction); err != nil {
+			log.Printf("ReadPump: failed to unmarshal cell action from player %s: %v", c.currentPlayerID(), err)
 			continue
 		}
 
-		cellAction.PlayerID = c.PlayerID
+		cellAction.PlayerID = c.currentPlayerID()
 
 		select {
 		case c.Hub.CellActionChannel <- cellAction:
 		default:
-			log.Printf("ReadPump: action channel full, dropping action from player %s", c.PlayerID)
+			log.Printf("ReadPump: action channel full, dropping action from player %s", c.currentPlayerID())
 		}
 	}
 }
 
+// currentPlayerID returns PlayerID for code running outside the hub
+func (c *Client) currentPlayerID() string {
+	c.idMu.RLock()
+	defer c.idMu.RUnlock()
+
+	return c.PlayerID
+}
+
+// allowAction takes a token from both the connection and the IP bucket, or
+// from neither if one of them is empty
+func (c *Client) allowAction() bool {
+	return ratelimit.AllowAll(c.actionLimiter, c.Hub.ipLimiters.Get(c.remoteIP))
+}
+
+// recordViolation counts a rate limited message, warns the client at most
+// once per second and reports whether the client should be disconnected
+func (c *Client) recordViolation() bool {
+	now := time.Now()
+	if now.Sub(c.violationsSince) > c.Hub.Config.RateViolationWindow {
+		c.violations = 0
+		c.violationsSince = now
+	}
+	c.violations++
+
+	if now.Sub(c.lastLimitWarning) >= time.Second {
+		c.lastLimitWarning = now
+		c.queue.push(NewMessage("ERROR", ErrorPayload{
+			Code:    "RATE_LIMITED",
+			Message: "Too many actions, slow down",
+		}))
+	}
+
+	return c.violations > c.Hub.Config.MaxRateViolations
+}
+
 func (c *Client) WritePump() {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
@@ -60,23 +136,25 @@ func (c *Client) WritePump() {
 
 	for {
 		select {
-		case message, ok := <-c.Send:
-			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
+		case <-c.queue.ready:
+			for {
+				message, closed, closeCode, closeText := c.queue.pop()
+				if closed {
+					c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+					closeMessage := []byte{}
+					if closeCode != 0 {
+						closeMessage = websocket.FormatCloseMessage(closeCode, closeText)
+					}
+					c.Conn.WriteMessage(websocket.CloseMessage, closeMessage)
+					return
+				}
+				if message == nil {
+					break
+				}
 
-			w, err := c.Conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			if _, err := w.Write(message); err != nil {
-				w.Close()
-				return
-			}
-			if err := w.Close(); err != nil {
-				return
+				if err := c.writeMessage(message); err != nil {
+					return
+				}
 			}
 		case <-ticker.C:
 			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
@@ -87,3 +165,44 @@ func (c *Client) WritePump() {
 		}
 	}
 }
+
+func (c *Client) writeMessage(message *Message) error {
+	data, err := message.Encode(c.Codec)
+	if err != nil {
+		log.Printf("WritePump: failed to encode %s message for player %s: %v", message.Type, c.currentPlayerID(), err)
+		return nil
+	}
+
+	compress := c.compress && len(data) >= c.Hub.Config.CompressionThreshold
+	c.Conn.EnableWriteCompression(compress)
+
+	written := c.bytesWritten()
+
+	c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+	w, err := c.Conn.NextWriter(c.Codec.FrameType())
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	if compress {
+		metrics.CompressedPayloadBytes.Add(int64(len(data)))
+		metrics.CompressedWireBytes.Add(c.bytesWritten() - written)
+	}
+	return nil
+}
+
+// bytesWritten returns the bytes written to the underlying connection if it
+// counts them, which the websocket handler arranges
+func (c *Client) bytesWritten() int64 {
+	if counter, ok := c.Conn.NetConn().(interface{ BytesWritten() int64 }); ok {
+		return counter.BytesWritten()
+	}
+	return 0
+}
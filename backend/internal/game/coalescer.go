@@ -0,0 +1,56 @@
+package game
+
+type cellKey struct {
+	x, y int
+}
+
+// pendingUpdates accumulates the updates of several cell actions into one
+// delta. Cell updates are merged per coordinate so only the latest state of
+// a cell is sent; scoreboard updates are kept in order because the client
+// applies them incrementally.
+type pendingUpdates struct {
+	cells      []CellAction
+	cellIndex  map[cellKey]int
+	scoreboard []ScoreboardAction
+}
+
+func newPendingUpdates() *pendingUpdates {
+	return &pendingUpdates{
+		cellIndex: make(map[cellKey]int),
+	}
+}
+
+func (p *pendingUpdates) add(updates *UpdateResult) {
+	if updates == nil {
+		return
+	}
+
+	for _, cellUpdate := range updates.CellUpdates {
+		key := cellKey{cellUpdate.X, cellUpdate.Y}
+		if i, ok := p.cellIndex[key]; ok {
+			p.cells[i] = cellUpdate
+			continue
+		}
+		p.cellIndex[key] = len(p.cells)
+		p.cells = append(p.cells, cellUpdate)
+	}
+
+	p.scoreboard = append(p.scoreboard, updates.ScoreboardUpdates...)
+}
+
+func (p *pendingUpdates) empty() bool {
+	return len(p.cells) == 0 && len(p.scoreboard) == 0
+}
+
+// take returns the merged delta and resets the accumulator
+func (p *pendingUpdates) take() *UpdateResult {
+	updates := newUpdateResult()
+	updates.CellUpdates = append(updates.CellUpdates, p.cells...)
+	updates.ScoreboardUpdates = append(updates.ScoreboardUpdates, p.scoreboard...)
+
+	p.cells = p.cells[:0]
+	p.scoreboard = p.scoreboard[:0]
+	clear(p.cellIndex)
+
+	return updates
+}
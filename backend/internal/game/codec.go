@@ -0,0 +1,96 @@
+package game
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	JSONSubprotocol    = "minesweeper.json"
+	MsgpackSubprotocol = "minesweeper.msgpack"
+)
+
+// Subprotocols lists the websocket subprotocols the server can negotiate, in
+// order of preference. Clients that don't request any of them get JSON.
+var Subprotocols = []string{MsgpackSubprotocol, JSONSubprotocol}
+
+// Codec encodes outgoing hub messages and decodes incoming client messages
+// for a single websocket connection
+type Codec interface {
+	Name() string
+	FrameType() int
+	Encode(message *Message) ([]byte, error)
+	Decode(data []byte, v any) error
+}
+
+// CodecForSubprotocol returns the codec for a negotiated subprotocol,
+// falling back to JSON
+func CodecForSubprotocol(subprotocol string) Codec {
+	switch subprotocol {
+	case MsgpackSubprotocol:
+		return MsgpackCodec
+	default:
+		return JSONCodec
+	}
+}
+
+// Message is a typed update sent from the hub to clients. The encoded form is
+// cached per codec so a broadcast is only marshalled once per wire format.
+type Message struct {
+	Type    string `json:"type" msgpack:"type"`
+	Payload any    `json:"payload" msgpack:"payload"`
+
+	mu      sync.Mutex
+	encoded map[string][]byte
+}
+
+func NewMessage(messageType string, payload any) *Message {
+	return &Message{
+		Type:    messageType,
+		Payload: payload,
+	}
+}
+
+// Encode returns the message encoded with the given codec
+func (m *Message) Encode(codec Codec) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if data, ok := m.encoded[codec.Name()]; ok {
+		return data, nil
+	}
+
+	data, err := codec.Encode(m)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.encoded == nil {
+		m.encoded = make(map[string][]byte)
+	}
+	m.encoded[codec.Name()] = data
+
+	return data, nil
+}
+
+var JSONCodec Codec = jsonCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return JSONSubprotocol
+}
+
+func (jsonCodec) FrameType() int {
+	return websocket.TextMessage
+}
+
+func (jsonCodec) Encode(message *Message) ([]byte, error) {
+	return json.Marshal(message)
+}
+
+func (jsonCodec) Decode(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
@@ -1,5 +1,15 @@
 package game
 
+import (
+	"compress/flate"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
 const (
 	GAMEBOARD_SIZE   = 10
 	MINES_MULTIPLIER = 0.1
@@ -7,3 +17,148 @@ const (
 	REVEAL_REWARD    = 1
 	MINE_HIT_PENALTY = 1000
 )
+
+// HubConfig holds the runtime tunables of a GameHub
+type HubConfig struct {
+	// RoomID identifies the room's snapshot in the database
+	RoomID string
+	// Hosts are the account IDs allowed to load boards into the room
+	Hosts []string
+	// SnapshotInterval is how often the round is saved so it can be
+	// restored after a restart. Zero only saves on shutdown.
+	SnapshotInterval time.Duration
+
+	// BroadcastTick enables coalescing: cell and scoreboard updates are
+	// merged and flushed once per tick. Zero broadcasts every action as-is.
+	BroadcastTick time.Duration
+	// SendQueueSize is the number of messages buffered per client before
+	// its backlog is collapsed into a board snapshot
+	SendQueueSize int
+	// MaxClientLag is how long a client's oldest pending message may wait
+	// before the client is disconnected
+	MaxClientLag time.Duration
+
+	// ActionRate and ActionBurst limit the cell actions a single connection
+	// may send per second; IPActionRate and IPActionBurst apply the same
+	// limit across all connections from one IP
+	ActionRate    float64
+	ActionBurst   int
+	IPActionRate  float64
+	IPActionBurst int
+	// MaxRateViolations is the number of rate limited messages tolerated
+	// within RateViolationWindow before the connection is closed
+	MaxRateViolations   int
+	RateViolationWindow time.Duration
+
+	// Compression enables permessage-deflate for clients that offer it.
+	// Messages shorter than CompressionThreshold bytes are sent uncompressed.
+	Compression          bool
+	CompressionThreshold int
+	CompressionLevel     int
+}
+
+// LoadHubConfig reads the hub configuration from the environment
+func LoadHubConfig() HubConfig {
+	roomID := os.Getenv("ROOM_ID")
+	if roomID == "" {
+		roomID = "main"
+	}
+
+	return HubConfig{
+		RoomID:           roomID,
+		Hosts:            envList("ROOM_HOST_IDS"),
+		SnapshotInterval: envMilliseconds("SNAPSHOT_INTERVAL_MS", 10*time.Second),
+
+		BroadcastTick: envMilliseconds("BROADCAST_TICK_MS", 0),
+		SendQueueSize: envInt("CLIENT_SEND_QUEUE_SIZE", 256),
+		MaxClientLag:  envMilliseconds("CLIENT_MAX_LAG_MS", 10*time.Second),
+
+		ActionRate:    envFloat("WS_ACTION_RATE", 20),
+		ActionBurst:   envInt("WS_ACTION_BURST", 40),
+		IPActionRate:  envFloat("WS_IP_ACTION_RATE", 60),
+		IPActionBurst: envInt("WS_IP_ACTION_BURST", 120),
+
+		MaxRateViolations:   envInt("WS_MAX_RATE_VIOLATIONS", 100),
+		RateViolationWindow: envMilliseconds("WS_RATE_VIOLATION_WINDOW_MS", 10*time.Second),
+
+		Compression:          os.Getenv("WS_COMPRESSION") != "off",
+		CompressionThreshold: envInt("WS_COMPRESSION_THRESHOLD", 512),
+		CompressionLevel:     envCompressionLevel("WS_COMPRESSION_LEVEL", flate.BestSpeed),
+	}
+}
+
+// IsHost reports whether the account may load boards into the room
+func (c HubConfig) IsHost(userID string) bool {
+	return userID != "" && slices.Contains(c.Hosts, userID)
+}
+
+// envList reads a comma-separated list, skipping empty entries
+func envList(name string) []string {
+	values := make([]string, 0)
+	for _, value := range strings.Split(os.Getenv(name), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func envCompressionLevel(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	level, err := strconv.Atoi(value)
+	if err != nil || level < flate.HuffmanOnly || level > flate.BestCompression {
+		log.Printf("Invalid %s=%q, using default %d", name, value, fallback)
+		return fallback
+	}
+
+	return level
+}
+
+func envFloat(name string, fallback float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f <= 0 {
+		log.Printf("Invalid %s=%q, using default %g", name, value, fallback)
+		return fallback
+	}
+
+	return f
+}
+
+func envInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Printf("Invalid %s=%q, using default %d", name, value, fallback)
+		return fallback
+	}
+
+	return n
+}
+
+func envMilliseconds(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	ms, err := strconv.Atoi(value)
+	if err != nil || ms < 0 {
+		log.Printf("Invalid %s=%q, using default %s", name, value, fallback)
+		return fallback
+	}
+
+	return time.Duration(ms) * time.Millisecond
+}
@@ -1,10 +1,45 @@
 package game
 
 import (
-	"math/rand"
+	"crypto/rand"
+	"encoding/binary"
+	mathrand "math/rand/v2"
 )
 
-func GenerateGameBoard() *GameBoard {
+// newSeed draws the seed of a new board. Seeds are published with past
+// matches, so they must not be guessable from when a round started. It is
+// never 0, which marks a loaded board.
+func newSeed() int64 {
+	var b [8]byte
+	for {
+		// Read never returns an error, it crashes the program instead
+		rand.Read(b[:])
+		if seed := int64(binary.BigEndian.Uint64(b[:])); seed != 0 {
+			return seed
+		}
+	}
+}
+
+// GenerateGameBoard lays out mines using the given seed, so the same seed
+// always produces the same board. Every bit of the seed counts.
+func GenerateGameBoard(seed int64) *GameBoard {
+	rng := mathrand.New(mathrand.NewPCG(uint64(seed), 0))
+
+	mines := make([][2]int, 0)
+	for i := range GAMEBOARD_SIZE {
+		for j := range GAMEBOARD_SIZE {
+			if randVal := rng.IntN(100); randVal < int(MINES_MULTIPLIER*100) {
+				mines = append(mines, [2]int{i, j})
+			}
+		}
+	}
+
+	return NewGameBoardFromMines(mines)
+}
+
+// NewGameBoardFromMines builds a fresh board with mines at the given
+// coordinates. Coordinates outside the board are ignored.
+func NewGameBoardFromMines(mines [][2]int) *GameBoard {
 	cells := make([][]Cell, GAMEBOARD_SIZE)
 
 	for i := range cells {
@@ -17,13 +52,13 @@ func GenerateGameBoard() *GameBoard {
 	}
 
 	minesSpawned := 0
-	for i := range GAMEBOARD_SIZE {
-		for j := range GAMEBOARD_SIZE {
-			if randVal := rand.Intn(100); randVal < int(MINES_MULTIPLIER*100) {
-				gameBoard.Cells[i][j].IsMine = true
-				minesSpawned++
-			}
+	for _, mine := range mines {
+		x, y := mine[0], mine[1]
+		if !isValidCoordinate(x, y) || gameBoard.Cells[x][y].IsMine {
+			continue
 		}
+		gameBoard.Cells[x][y].IsMine = true
+		minesSpawned++
 	}
 
 	gameBoard.CellsToReveal -= minesSpawned
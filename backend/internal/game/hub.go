@@ -1,15 +1,21 @@
 package game
 
 import (
-	"encoding/json"
+	"context"
 	"log"
+	"sync"
 	"time"
 
-	"github.com/gameoflife0880/web_minesweeper/backend/pkg"
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/db"
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/metrics"
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/ratelimit"
+	"github.com/gorilla/websocket"
 )
 
-func NewGameHub() *GameHub {
-	gameBoard := GenerateGameBoard()
+func NewGameHub(config HubConfig, store *db.Store) *GameHub {
+	now := time.Now()
+	seed := newSeed()
+	gameBoard := GenerateGameBoard(seed)
 
 	hub := &GameHub{
 		GameBoard: *gameBoard,
@@ -19,33 +25,108 @@ func NewGameHub() *GameHub {
 		Register:          make(chan *Client),
 		Unregister:        make(chan *Client),
 		CellActionChannel: make(chan CellAction),
-		Broadcast:         make(chan []byte, 256), // Buffered to prevent blocking
-		RestartTimer:      make(chan struct{}),
+		RestartTimer:      make(chan int),
 
-		StartTime:   time.Now().Unix(),
+		StartTime:   now.Unix(),
 		GameStatus:  InProgress,
 		RestartTime: 0,
-		shutdown:    make(chan struct{}),
+		Seed:        seed,
+
+		Config:  config,
+		store:   store,
+		pending: newPendingUpdates(),
+
+		ipLimiters: ratelimit.NewRegistry(config.IPActionRate, config.IPActionBurst),
+
+		departedPlayers: make(map[string]Player),
+		matchRecords:    make(chan *roundRecord, 16),
+		upgradedGuests:  make(map[string]string),
+		roundStartedAt:  now,
+
+		loadLayout: make(chan *BoardLayout),
+
+		snapshots: make(chan *db.RoomSnapshot, 1),
+		done:      make(chan struct{}),
+
+		shutdown: make(chan struct{}),
 	}
 
 	return hub
 }
 
 func (h *GameHub) Run() {
+	var writers sync.WaitGroup
+	writers.Add(2)
+	go func() {
+		defer writers.Done()
+		h.writeMatchRecords()
+	}()
+	go func() {
+		defer writers.Done()
+		h.writeSnapshots()
+	}()
+
+	// final is saved once the writers are done, so no snapshot still
+	// queued can overwrite it
+	var final *db.RoomSnapshot
 	defer func() {
+		close(h.matchRecords)
+		close(h.snapshots)
+		writers.Wait()
+		if final != nil {
+			h.saveSnapshot(final)
+		}
+
 		log.Println("GameHub stopped")
+		close(h.done)
 	}()
 
+	var snapshotTick <-chan time.Time
+	if h.Config.SnapshotInterval > 0 {
+		ticker := time.NewTicker(h.Config.SnapshotInterval)
+		defer ticker.Stop()
+		snapshotTick = ticker.C
+	}
+
+	var broadcastTick <-chan time.Time
+	if h.Config.BroadcastTick > 0 {
+		ticker := time.NewTicker(h.Config.BroadcastTick)
+		defer ticker.Stop()
+		broadcastTick = ticker.C
+	}
+
 	for {
 		select {
 		case <-h.shutdown:
+			h.BoardLock.Lock()
+			final = h.buildSnapshot()
+			h.BoardLock.Unlock()
 			return
+		case <-snapshotTick:
+			h.BoardLock.RLock()
+			h.queueSnapshot()
+			h.BoardLock.RUnlock()
 		case client := <-h.Register:
 			h.BoardLock.Lock()
 			h.Clients[client.PlayerID] = client
-			h.Players[client.PlayerID] = &Player{
-				PlayerID:   client.PlayerID,
-				PlayerName: pkg.GenerateNickname(),
+			now := time.Now()
+			if player, ok := h.departedPlayers[client.PlayerID]; ok {
+				// Reconnecting in the same round resumes the player's results.
+				// Guests get a new ID on every connection, so only accounts
+				// can resume.
+				if client.IsLoggedIn && client.PlayerName != "" {
+					player.PlayerName = client.PlayerName
+				}
+				player.join(now)
+				h.Players[client.PlayerID] = &player
+				delete(h.departedPlayers, client.PlayerID)
+			} else {
+				h.Players[client.PlayerID] = &Player{
+					PlayerID:   client.PlayerID,
+					PlayerName: h.assignPlayerName(client),
+					IsLoggedIn: client.IsLoggedIn,
+					joinedAt:   now,
+				}
 			}
 
 			scoreboardUpdates := map[string]ScoreboardAction{
@@ -56,19 +137,9 @@ func (h *GameHub) Run() {
 			}
 			h.BroadcastUpdates("REGISTER", scoreboardUpdates)
 
-			payload := h.GetGameBoardState()
-			gameBoardState := map[string]any{
-				"type":    "GAMEBOARD_STATE",
-				"payload": payload,
-			}
-			if jsonGameBoardState, err := json.Marshal(gameBoardState); err != nil {
-				log.Printf("Failed to marshal game board state for player %s: %v", client.PlayerID, err)
-			} else {
-				select {
-				case client.Send <- jsonGameBoardState:
-				default:
-					log.Printf("Failed to send game board state to player %s: channel full", client.PlayerID)
-				}
+			h.deliver(client, NewMessage("GAMEBOARD_STATE", h.GetGameBoardState()))
+			if !client.IsLoggedIn {
+				h.startGuestSession(client)
 			}
 			h.BoardLock.Unlock()
 			log.Printf("Player %s joined. Total players: %d", client.PlayerID, len(h.Players))
@@ -84,11 +155,13 @@ func (h *GameHub) Run() {
 					}
 
 					h.BroadcastUpdates("UNREGISTER", scoreboardUpdates)
+					player.leave(time.Now())
+					h.departedPlayers[client.PlayerID] = *player
 				}
 
 				delete(h.Players, client.PlayerID)
 				delete(h.Clients, client.PlayerID)
-				close(client.Send)
+				client.queue.close(0, "")
 			}
 			h.BoardLock.Unlock()
 			log.Printf("Player %s left. Total players: %d", client.PlayerID, len(h.Players))
@@ -97,35 +170,38 @@ func (h *GameHub) Run() {
 				continue
 			}
 			h.BoardLock.Lock()
-			updates := h.HandleCellAction(cellAction)
-			h.BroadcastUpdates("CELL", updates)
+			if userID, ok := h.upgradedGuests[cellAction.PlayerID]; ok {
+				cellAction.PlayerID = userID
+			}
+			updates := h.applyCellAction(cellAction)
+			h.recordAction(cellAction, updates)
+			if h.Config.BroadcastTick > 0 {
+				h.pending.add(updates)
+			} else {
+				h.BroadcastUpdates("CELL", updates.toMap())
+			}
 
 			h.CheckWinCondition()
 
 			h.BoardLock.Unlock()
-		case message := <-h.Broadcast:
-			h.BoardLock.RLock()
-			clients := make([]*Client, 0, len(h.Clients))
-			for _, c := range h.Clients {
-				clients = append(clients, c)
-			}
-			h.BoardLock.RUnlock()
-
-			for _, c := range clients {
-				select {
-				case c.Send <- message:
-				default:
-					log.Printf("Failed to send message to %s", c.PlayerID)
-					select {
-					case h.Unregister <- c:
-					default:
-						log.Printf("Failed to unregister client %s: channel full", c.PlayerID)
-					}
-				}
+		case <-broadcastTick:
+			h.BoardLock.Lock()
+			h.flushPendingUpdates()
+			h.BoardLock.Unlock()
+		case round := <-h.RestartTimer:
+			h.BoardLock.Lock()
+			// A loaded board may already have started the next round, and
+			// that round may have ended too
+			if round == h.round && h.GameStatus == Ended {
+				h.RestartGame()
 			}
-		case <-h.RestartTimer:
+			h.BoardLock.Unlock()
+		case layout := <-h.loadLayout:
 			h.BoardLock.Lock()
-			h.RestartGame()
+			if h.GameStatus == InProgress {
+				log.Println("Abandoning current round to load a board")
+			}
+			h.startRound(layout.Board(), 0, layout.Revealed)
 			h.BoardLock.Unlock()
 		}
 	}
@@ -136,20 +212,46 @@ func (h *GameHub) BroadcastUpdates(actionType string, payload any) {
 		return
 	}
 
-	jsonUpdates, err := json.Marshal(map[string]any{
-		"type":    actionType,
-		"payload": payload,
-	})
-	if err != nil {
-		log.Printf("BroadcastUpdates: failed to marshal updates: %v", err)
+	// Coalesced cell updates must reach clients before anything that
+	// depends on them, such as a status change or a fresh board
+	if actionType != "CELL" {
+		h.flushPendingUpdates()
+	}
+
+	message := NewMessage(actionType, payload)
+	for _, client := range h.Clients {
+		h.deliver(client, message)
+	}
+}
+
+// deliver queues a message for a client without blocking the hub. A client
+// whose queue overflows has its backlog collapsed into a fresh board
+// snapshot; one that stays behind for longer than MaxClientLag is
+// disconnected.
+func (h *GameHub) deliver(client *Client, message *Message) {
+	if lag := client.queue.lag(); lag > h.Config.MaxClientLag {
+		log.Printf("Disconnecting player %s: %s behind", client.PlayerID, lag.Round(time.Millisecond))
+		metrics.SlowClientDisconnects.Add(1)
+		client.queue.close(websocket.CloseTryAgainLater, "client too slow")
 		return
 	}
 
-	select {
-	case h.Broadcast <- jsonUpdates:
-	default:
-		log.Printf("BroadcastUpdates: channel full, dropping message type: %s", actionType)
+	if client.queue.push(message) {
+		return
 	}
+
+	log.Printf("Send queue full for player %s, replacing backlog with a snapshot", client.PlayerID)
+	metrics.SendQueueCollapses.Add(1)
+	client.queue.collapse(NewMessage("GAMEBOARD_STATE", h.GetGameBoardState()))
+}
+
+// flushPendingUpdates broadcasts the coalesced delta, if any
+func (h *GameHub) flushPendingUpdates() {
+	if h.pending.empty() {
+		return
+	}
+
+	h.BroadcastUpdates("CELL", h.pending.take().toMap())
 }
 
 func (h *GameHub) HandleCellAction(action CellAction) map[string][]any {
@@ -159,6 +261,16 @@ func (h *GameHub) HandleCellAction(action CellAction) map[string][]any {
 		}
 	}
 
+	return h.applyCellAction(action).toMap()
+}
+
+// applyCellAction applies a cell action to the board and returns the
+// resulting updates, which are empty if the action had no effect
+func (h *GameHub) applyCellAction(action CellAction) *UpdateResult {
+	if !isValidCoordinate(action.X, action.Y) {
+		return newUpdateResult()
+	}
+
 	var updates *UpdateResult
 
 	switch action.Type {
@@ -166,15 +278,13 @@ func (h *GameHub) HandleCellAction(action CellAction) map[string][]any {
 		updates = h.CellReveal(action.X, action.Y, action.PlayerID)
 	case "FLAG":
 		updates = h.CellFlag(action.X, action.Y, action.PlayerID)
-	default:
-		return newUpdateResult().toMap()
 	}
 
 	if updates == nil {
-		return newUpdateResult().toMap()
+		return newUpdateResult()
 	}
 
-	return updates.toMap()
+	return updates
 }
 
 func (h *GameHub) CellReveal(x int, y int, playerID string) *UpdateResult {
@@ -251,6 +361,7 @@ func (h *GameHub) CellFloodReveal(x int, y int, playerID string) *UpdateResult {
 	if h.GameBoard.CellsToReveal > 0 {
 		h.GameBoard.CellsToReveal -= 1
 	}
+	player.TotalReveals += 1
 	score := calculateScore(cell.AdjacentMines)
 	player.Score += score
 	scoreIncrement += score
@@ -289,6 +400,7 @@ func (h *GameHub) CellFloodReveal(x int, y int, playerID string) *UpdateResult {
 						if h.GameBoard.CellsToReveal > 0 {
 							h.GameBoard.CellsToReveal -= 1
 						}
+						player.TotalReveals += 1
 						score := calculateScore(neighborCell.AdjacentMines)
 						player.Score += score
 						scoreIncrement += score
@@ -426,30 +538,71 @@ func (h *GameHub) CheckWinCondition() {
 
 		log.Println("Game ended, will restart in 30 seconds")
 
-		go func() {
-			time.Sleep(30 * time.Second)
-			select {
-			case h.RestartTimer <- struct{}{}:
-			default:
-				log.Println("RestartTimer channel full, skipping restart")
-			}
-		}()
+		h.recordMatch()
+		h.scheduleRestart(h.round, 30*time.Second)
 	}
 }
 
+// scheduleRestart starts a new round after delay, unless round has been
+// replaced by then. The restart waits for Run to pick it up, so it is not
+// lost if the hub is busy or not running yet.
+func (h *GameHub) scheduleRestart(round int, delay time.Duration) {
+	go func() {
+		time.Sleep(delay)
+		select {
+		case h.RestartTimer <- round:
+		case <-h.shutdown:
+		}
+	}()
+}
+
 func (h *GameHub) RestartGame() {
-	gameBoard := GenerateGameBoard()
-	h.GameBoard = *gameBoard
+	seed := newSeed()
+	h.startRound(GenerateGameBoard(seed), seed, nil)
+}
 
+// LoadLayout starts a new round on the given board, abandoning the current
+// round without recording it. The layout must be valid.
+func (h *GameHub) LoadLayout(layout *BoardLayout) {
+	select {
+	case h.loadLayout <- layout:
+	case <-h.shutdown:
+	}
+}
+
+// CurrentLayout returns the layout of the current round's board
+func (h *GameHub) CurrentLayout(includeRevealed bool) *BoardLayout {
+	h.BoardLock.RLock()
+	defer h.BoardLock.RUnlock()
+
+	return LayoutFromBoard(&h.GameBoard, includeRevealed)
+}
+
+// startRound resets the room onto a new board. A seed of 0 marks a board
+// that was loaded rather than generated.
+func (h *GameHub) startRound(board *GameBoard, seed int64, revealed [][2]int) {
+	now := time.Now()
+	h.Seed = seed
+	h.GameBoard = *board
+
+	h.round++
 	h.GameStatus = InProgress
-	h.StartTime = time.Now().Unix()
+	h.StartTime = now.Unix()
 	h.RestartTime = 0
+	h.roundStartedAt = now
+	h.roundActions = nil
+	h.roundRevealed = revealed
 
 	for _, player := range h.Players {
 		player.Score = 0
+		player.TotalReveals = 0
 		player.TotalMineHits = 0
 		player.ActiveFlagCount = 0
+		player.playTime = 0
+		player.join(now)
 	}
+	clear(h.departedPlayers)
+	clear(h.upgradedGuests)
 
 	log.Println("Game restarted")
 
@@ -457,6 +610,64 @@ func (h *GameHub) RestartGame() {
 	h.BroadcastUpdates("GAMEBOARD_STATE", payload)
 }
 
+// CloseSession disconnects every client that connected with a token from
+// the given session, once it has been revoked
+func (h *GameHub) CloseSession(sessionID string) {
+	h.BoardLock.RLock()
+	defer h.BoardLock.RUnlock()
+
+	for _, client := range h.Clients {
+		if client.SessionID == sessionID {
+			client.queue.close(CloseSessionRevoked, "session revoked")
+		}
+	}
+}
+
+// ForgetPlayer removes a deleted account from the current round. Its
+// results, flags and logged actions stay under the anonymous player, who
+// counts as a guest, and a connected client of the account is dropped. It
+// returns once rounds the account finished earlier are stored, so they can
+// be anonymised along with the rest of its history.
+func (h *GameHub) ForgetPlayer(ctx context.Context, userID string, anonymous db.ReplayPlayer) error {
+	h.BoardLock.Lock()
+	if client, ok := h.Clients[userID]; ok {
+		if player, ok := h.Players[userID]; ok {
+			h.BroadcastUpdates("UNREGISTER", map[string]ScoreboardAction{
+				"scoreboardUpdates": {Type: "UNREGISTER", Player: *player},
+			})
+			player.leave(time.Now())
+			h.departedPlayers[userID] = *player
+		}
+		delete(h.Players, userID)
+		delete(h.Clients, userID)
+		client.queue.close(CloseSessionRevoked, "account deleted")
+	}
+
+	if player, ok := h.departedPlayers[userID]; ok {
+		player.PlayerID = anonymous.PlayerID
+		player.PlayerName = anonymous.PlayerName
+		player.IsLoggedIn = false
+		h.departedPlayers[anonymous.PlayerID] = player
+		delete(h.departedPlayers, userID)
+	}
+	for guestID, accountID := range h.upgradedGuests {
+		if accountID == userID {
+			h.upgradedGuests[guestID] = anonymous.PlayerID
+		}
+	}
+	h.reassignRound(userID, anonymous.PlayerID)
+	h.queueSnapshot()
+	h.BoardLock.Unlock()
+
+	return h.flushMatchRecords(ctx)
+}
+
 func (h *GameHub) Shutdown() chan struct{} {
 	return h.shutdown
 }
+
+// Done is closed once Run has returned and pending records and the final
+// snapshot have been written
+func (h *GameHub) Done() <-chan struct{} {
+	return h.done
+}
@@ -0,0 +1,190 @@
+package game
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrLayoutSize        = fmt.Errorf("board must be %dx%d", GAMEBOARD_SIZE, GAMEBOARD_SIZE)
+	ErrLayoutCoordinate  = errors.New("coordinate outside the board")
+	ErrLayoutRevealsMine = errors.New("a mine cannot start revealed")
+	ErrLayoutCleared     = errors.New("board has no safe cells left to reveal")
+)
+
+// BoardLayout describes a board independently of any round: its size, its
+// mines and, optionally, cells that start out revealed. Coordinates are
+// [row, column], the same as GameBoard.Cells.
+//
+// In text form a layout is one line per row. '*' is a mine, '.' a hidden
+// safe cell and a digit a revealed safe cell; the digit's value is ignored
+// as it is always recalculated. 'F' and 'f' are read as a hidden mine and a
+// hidden safe cell, so EncodeBoardRows output can be loaded back, and lines
+// starting with '#' are comments.
+type BoardLayout struct {
+	Width    int      `json:"width"`
+	Height   int      `json:"height"`
+	Mines    [][2]int `json:"mines"`
+	Revealed [][2]int `json:"revealed,omitempty"`
+}
+
+// LayoutFromBoard captures the mines of a board, and its revealed cells if
+// includeRevealed is set
+func LayoutFromBoard(board *GameBoard, includeRevealed bool) *BoardLayout {
+	layout := &BoardLayout{
+		Height: len(board.Cells),
+		Mines:  make([][2]int, 0),
+	}
+	if layout.Height > 0 {
+		layout.Width = len(board.Cells[0])
+	}
+
+	for i, row := range board.Cells {
+		for j, cell := range row {
+			if cell.IsMine {
+				layout.Mines = append(layout.Mines, [2]int{i, j})
+			}
+			if includeRevealed && cell.IsRevealed && !cell.IsMine {
+				layout.Revealed = append(layout.Revealed, [2]int{i, j})
+			}
+		}
+	}
+
+	return layout
+}
+
+// ParseBoardLayout reads a layout in text form
+func ParseBoardLayout(data []byte) (*BoardLayout, error) {
+	layout := &BoardLayout{Mines: make([][2]int, 0)}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		row := layout.Height
+		if row == 0 {
+			layout.Width = len(line)
+		} else if len(line) != layout.Width {
+			return nil, fmt.Errorf("row %d has %d cells, expected %d", row+1, len(line), layout.Width)
+		}
+
+		for col, char := range []byte(line) {
+			switch {
+			case char == '*' || char == 'F':
+				layout.Mines = append(layout.Mines, [2]int{row, col})
+			case char == '.' || char == 'f':
+			case char >= '0' && char <= '8':
+				layout.Revealed = append(layout.Revealed, [2]int{row, col})
+			case char == 'X':
+				return nil, ErrLayoutRevealsMine
+			default:
+				return nil, fmt.Errorf("row %d has unknown cell %q", row+1, char)
+			}
+		}
+		layout.Height++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return layout, nil
+}
+
+// Text renders the layout in text form
+func (l *BoardLayout) Text() ([]byte, error) {
+	if err := l.checkCoordinates(); err != nil {
+		return nil, err
+	}
+
+	rows := make([][]byte, l.Height)
+	for i := range rows {
+		rows[i] = bytes.Repeat([]byte{'.'}, l.Width)
+	}
+	for _, mine := range l.Mines {
+		rows[mine[0]][mine[1]] = '*'
+	}
+	for _, revealed := range l.Revealed {
+		x, y := revealed[0], revealed[1]
+		if rows[x][y] == '*' {
+			return nil, ErrLayoutRevealsMine
+		}
+
+		count := 0
+		for i := max(x-1, 0); i <= min(x+1, l.Height-1); i++ {
+			for j := max(y-1, 0); j <= min(y+1, l.Width-1); j++ {
+				if rows[i][j] == '*' {
+					count++
+				}
+			}
+		}
+		rows[x][y] = byte('0' + count)
+	}
+
+	var buf bytes.Buffer
+	for _, row := range rows {
+		buf.Write(row)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// Validate checks that the layout can be played on this server
+func (l *BoardLayout) Validate() error {
+	if l.Width != GAMEBOARD_SIZE || l.Height != GAMEBOARD_SIZE {
+		return ErrLayoutSize
+	}
+	if err := l.checkCoordinates(); err != nil {
+		return err
+	}
+
+	board := l.Board()
+	for _, revealed := range l.Revealed {
+		if board.Cells[revealed[0]][revealed[1]].IsMine {
+			return ErrLayoutRevealsMine
+		}
+	}
+	if board.CellsToReveal == 0 {
+		return ErrLayoutCleared
+	}
+
+	return nil
+}
+
+// Board builds a fresh game board from a valid layout
+func (l *BoardLayout) Board() *GameBoard {
+	board := NewGameBoardFromMines(l.Mines)
+	revealCells(board, l.Revealed)
+	return board
+}
+
+func (l *BoardLayout) checkCoordinates() error {
+	for _, cells := range [][][2]int{l.Mines, l.Revealed} {
+		for _, cell := range cells {
+			if cell[0] < 0 || cell[0] >= l.Height || cell[1] < 0 || cell[1] >= l.Width {
+				return ErrLayoutCoordinate
+			}
+		}
+	}
+	return nil
+}
+
+// revealCells marks cells as revealed without scoring them, for boards that
+// start part way through
+func revealCells(board *GameBoard, cells [][2]int) {
+	for _, cell := range cells {
+		x, y := cell[0], cell[1]
+		if !isValidCoordinate(x, y) || board.Cells[x][y].IsRevealed {
+			continue
+		}
+		board.Cells[x][y].IsRevealed = true
+		if !board.Cells[x][y].IsMine && board.CellsToReveal > 0 {
+			board.CellsToReveal -= 1
+		}
+	}
+}
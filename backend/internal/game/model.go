@@ -2,7 +2,10 @@ package game
 
 import (
 	"sync"
+	"time"
 
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/db"
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/ratelimit"
 	"github.com/gorilla/websocket"
 )
 
@@ -24,12 +27,47 @@ type GameHub struct {
 	Register          chan *Client
 	Unregister        chan *Client
 	CellActionChannel chan CellAction
-	Broadcast         chan []byte
-	RestartTimer      chan struct{}
+	// RestartTimer receives the number of the round a restart was
+	// scheduled for
+	RestartTimer chan int
 
 	StartTime   int64
 	GameStatus  GameStatus
 	RestartTime int64
+	Seed        int64
+
+	Config  HubConfig
+	store   *db.Store
+	pending *pendingUpdates
+
+	// ReservedName reports whether a name is reserved, so guests cannot
+	// pick it as their nickname. It must be set before Run, if at all.
+	ReservedName func(name string) bool
+
+	ipLimiters *ratelimit.Registry
+
+	// departedPlayers keeps the results of players who left mid-round so
+	// they are still part of the match record
+	departedPlayers map[string]Player
+	matchRecords    chan *roundRecord
+	// upgradedGuests maps guests who upgraded this round to their account,
+	// for actions that were sent before the upgrade
+	upgradedGuests map[string]string
+
+	// round numbers the rounds since the hub started, so a restart
+	// scheduled for an earlier round can be told apart
+	round int
+	// roundStartedAt and roundActions make up the replay log of the
+	// current round
+	roundStartedAt time.Time
+	roundActions   []db.ReplayAction
+	// roundRevealed holds the cells a loaded board started with revealed
+	roundRevealed [][2]int
+
+	loadLayout chan *BoardLayout
+
+	snapshots chan *db.RoomSnapshot
+	done      chan struct{}
 
 	shutdown chan struct{}
 }
@@ -46,8 +84,34 @@ type GameBoard struct {
 type Client struct {
 	Hub      *GameHub
 	Conn     *websocket.Conn
-	Send     chan []byte
+	Codec    Codec
 	PlayerID string
+	// IsLoggedIn is set for clients that connected with a valid token, in
+	// which case PlayerID is the account's user ID and SessionID the login
+	// the token belongs to
+	IsLoggedIn bool
+	SessionID  string
+	// PlayerName is the account's display name for logged-in clients, or
+	// the nickname a guest asked for. Guests without one, or whose choice
+	// is rejected, get a generated nickname.
+	PlayerName string
+
+	// idMu guards PlayerID, which the hub changes when a guest upgrades to
+	// an account, against the pumps reading it
+	idMu sync.RWMutex
+	// guestToken lets a guest prove the connection is theirs when they
+	// upgrade, see GameHub.UpgradeGuest
+	guestToken string
+
+	queue    *sendQueue
+	compress bool
+
+	actionLimiter *ratelimit.Bucket
+	// remoteIP picks the bucket shared by connections from one address
+	remoteIP         string
+	violations       int
+	violationsSince  time.Time
+	lastLimitWarning time.Time
 }
 
 type Player struct {
@@ -55,9 +119,34 @@ type Player struct {
 	PlayerName      string `json:"playerName"`
 	Score           int    `json:"score"`
 	TotalDefuses    int    `json:"totalDefuses"`
+	TotalReveals    int    `json:"totalReveals"`
 	TotalMineHits   int    `json:"totalMineHits"`
 	ActiveFlagCount int    `json:"activeFlagCount"`
 	IsLoggedIn      bool   `json:"isLoggedIn"`
+
+	// playTime is the time spent in the round up to joinedAt, the last time
+	// the player joined. joinedAt is zero while the player is away.
+	playTime time.Duration
+	joinedAt time.Time
+}
+
+// join starts counting the player's time in the round
+func (p *Player) join(now time.Time) {
+	p.joinedAt = now
+}
+
+// leave stops counting the player's time in the round
+func (p *Player) leave(now time.Time) {
+	p.playTime = p.timePlayed(now)
+	p.joinedAt = time.Time{}
+}
+
+// timePlayed is how long the player has been in the round by now
+func (p *Player) timePlayed(now time.Time) time.Duration {
+	if p.joinedAt.IsZero() {
+		return p.playTime
+	}
+	return p.playTime + now.Sub(p.joinedAt)
 }
 
 type Cell struct {
@@ -68,12 +157,19 @@ type Cell struct {
 	FlagOwnerID   string    `json:"flagOwnerID"`
 }
 
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
 type WebsocketAction struct {
 	Type    string `json:"type"`
 	Payload any    `json:"payload"`
 }
 
 type CellAction struct {
+	_msgpack struct{} `msgpack:",as_array"`
+
 	Type     string `json:"type"`
 	X        int    `json:"x"`
 	Y        int    `json:"y"`
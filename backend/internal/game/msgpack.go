@@ -0,0 +1,136 @@
+package game
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+)
+
+// MsgpackCodec encodes messages as binary MessagePack frames. Structs keep
+// their JSON field names, except for the two types that dominate large
+// updates: CellAction is encoded as an array [type, x, y, playerID, cell]
+// and Cell is packed into a single integer (see packCell).
+var MsgpackCodec Codec = msgpackCodec{}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return MsgpackSubprotocol
+}
+
+func (msgpackCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+func (msgpackCodec) Encode(message *Message) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+
+	if err := enc.Encode(message); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Decode accepts structs either as maps with the JSON field names or in
+// array form, as used for outgoing cell actions
+func (msgpackCodec) Decode(data []byte, v any) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+
+	return dec.Decode(v)
+}
+
+const (
+	cellAdjacentMask = 0x0f
+	cellRevealedBit  = 1 << 4
+	cellMineBit      = 1 << 5
+	cellFlagBit      = 1 << 6
+)
+
+// packCell stores adjacent mines in the low four bits followed by the
+// revealed, mine and flag bits
+func packCell(c Cell) uint8 {
+	packed := uint8(c.AdjacentMines) & cellAdjacentMask
+	if c.IsRevealed {
+		packed |= cellRevealedBit
+	}
+	if c.IsMine {
+		packed |= cellMineBit
+	}
+	if c.FlagState == Placed {
+		packed |= cellFlagBit
+	}
+	return packed
+}
+
+func unpackCell(packed uint8) Cell {
+	c := Cell{
+		AdjacentMines: int(packed & cellAdjacentMask),
+		IsRevealed:    packed&cellRevealedBit != 0,
+		IsMine:        packed&cellMineBit != 0,
+	}
+	if packed&cellFlagBit != 0 {
+		c.FlagState = Placed
+	}
+	return c
+}
+
+// EncodeMsgpack writes the packed cell, or [packed, flagOwnerID] when the
+// cell carries a flag owner
+func (c Cell) EncodeMsgpack(enc *msgpack.Encoder) error {
+	if c.FlagOwnerID == "" {
+		return enc.EncodeUint8(packCell(c))
+	}
+
+	if err := enc.EncodeArrayLen(2); err != nil {
+		return err
+	}
+	if err := enc.EncodeUint8(packCell(c)); err != nil {
+		return err
+	}
+	return enc.EncodeString(c.FlagOwnerID)
+}
+
+func (c *Cell) DecodeMsgpack(dec *msgpack.Decoder) error {
+	code, err := dec.PeekCode()
+	if err != nil {
+		return err
+	}
+
+	if !msgpcode.IsFixedArray(code) && code != msgpcode.Array16 && code != msgpcode.Array32 {
+		packed, err := dec.DecodeUint8()
+		if err != nil {
+			return err
+		}
+		*c = unpackCell(packed)
+		return nil
+	}
+
+	n, err := dec.DecodeArrayLen()
+	if err != nil {
+		return err
+	}
+	if n != 2 {
+		return fmt.Errorf("msgpack: invalid cell array length %d", n)
+	}
+
+	packed, err := dec.DecodeUint8()
+	if err != nil {
+		return err
+	}
+	ownerID, err := dec.DecodeString()
+	if err != nil {
+		return err
+	}
+
+	*c = unpackCell(packed)
+	c.FlagOwnerID = ownerID
+	return nil
+}
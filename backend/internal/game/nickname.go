@@ -0,0 +1,64 @@
+package game
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gameoflife0880/web_minesweeper/backend/pkg"
+)
+
+var (
+	ErrNicknameTaken    = errors.New("nickname is already taken in this room")
+	ErrNicknameReserved = errors.New("nickname is reserved")
+)
+
+// assignPlayerName picks the name a newly joined player is shown with.
+// Logged-in players keep their account's name. A guest's chosen nickname
+// must be valid, not reserved and not used by anyone else in the round;
+// otherwise the guest is told why and gets a generated one. It must be
+// called with BoardLock held.
+func (h *GameHub) assignPlayerName(client *Client) string {
+	if client.IsLoggedIn && client.PlayerName != "" {
+		return client.PlayerName
+	}
+
+	if client.PlayerName != "" {
+		err := pkg.ValidateNickname(client.PlayerName)
+		if err == nil && h.ReservedName != nil && h.ReservedName(client.PlayerName) {
+			err = ErrNicknameReserved
+		}
+		if err == nil && h.nameTaken(client.PlayerName) {
+			err = ErrNicknameTaken
+		}
+		if err == nil {
+			return client.PlayerName
+		}
+
+		h.deliver(client, NewMessage("ERROR", ErrorPayload{
+			Code:    "INVALID_NICKNAME",
+			Message: err.Error(),
+		}))
+	}
+
+	name := pkg.GenerateNickname()
+	for attempt := 0; attempt < 10 && h.nameTaken(name); attempt++ {
+		name = pkg.GenerateNickname()
+	}
+	return name
+}
+
+// nameTaken reports whether a player in the round, present or departed,
+// already uses the name, ignoring case
+func (h *GameHub) nameTaken(name string) bool {
+	for _, player := range h.Players {
+		if strings.EqualFold(player.PlayerName, name) {
+			return true
+		}
+	}
+	for _, player := range h.departedPlayers {
+		if strings.EqualFold(player.PlayerName, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package game
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/metrics"
+)
+
+type queuedMessage struct {
+	message    *Message
+	enqueuedAt time.Time
+}
+
+// sendQueue is a client's outgoing message buffer. The hub pushes to it
+// without blocking and the client's WritePump drains it.
+type sendQueue struct {
+	mu       sync.Mutex
+	messages []queuedMessage
+	limit    int
+	ready    chan struct{}
+
+	closed    bool
+	closeCode int
+	closeText string
+}
+
+func newSendQueue(limit int) *sendQueue {
+	return &sendQueue{
+		limit: limit,
+		ready: make(chan struct{}, 1),
+	}
+}
+
+// push appends a message, returning false if the queue is full
+func (q *sendQueue) push(message *Message) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return true
+	}
+	if len(q.messages) >= q.limit {
+		return false
+	}
+
+	q.messages = append(q.messages, queuedMessage{message: message, enqueuedAt: time.Now()})
+	metrics.SendQueueDepth.Add(1)
+	metrics.SetMax(metrics.SendQueuePeak, int64(len(q.messages)))
+	q.signal()
+
+	return true
+}
+
+// collapse drops every pending message in favour of a single snapshot. The
+// snapshot keeps the age of the oldest dropped message so lag keeps growing
+// for a client that never catches up.
+func (q *sendQueue) collapse(snapshot *Message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+
+	enqueuedAt := time.Now()
+	if len(q.messages) > 0 {
+		enqueuedAt = q.messages[0].enqueuedAt
+	}
+
+	metrics.SendQueueDepth.Add(int64(1 - len(q.messages)))
+	q.messages = append(q.messages[:0], queuedMessage{message: snapshot, enqueuedAt: enqueuedAt})
+	q.signal()
+}
+
+// lag returns how long the oldest pending message has been waiting
+func (q *sendQueue) lag() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.messages) == 0 {
+		return 0
+	}
+	return time.Since(q.messages[0].enqueuedAt)
+}
+
+// pop removes the oldest message. When the queue is empty and closed it
+// returns closed=true with the close code and reason to send.
+func (q *sendQueue) pop() (message *Message, closed bool, closeCode int, closeText string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.messages) > 0 && !q.closed {
+		message = q.messages[0].message
+		q.messages[0] = queuedMessage{}
+		q.messages = q.messages[1:]
+		metrics.SendQueueDepth.Add(-1)
+		return message, false, 0, ""
+	}
+
+	return nil, q.closed, q.closeCode, q.closeText
+}
+
+// close discards pending messages and tells the writer to send a close
+// frame. A zero code sends an empty close frame.
+func (q *sendQueue) close(code int, text string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+
+	metrics.SendQueueDepth.Add(int64(-len(q.messages)))
+	q.messages = nil
+	q.closed = true
+	q.closeCode = code
+	q.closeText = text
+	q.signal()
+}
+
+func (q *sendQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,244 @@
+package game
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const matchWriteTimeout = 10 * time.Second
+
+// roundRecord is a finished round waiting to be written, or a guest whose
+// written rounds move to an account once earlier rounds are stored
+type roundRecord struct {
+	match  *db.Match
+	replay *db.Replay
+
+	claim *guestClaim
+	// flushed is closed once every record queued before it is stored
+	flushed chan struct{}
+}
+
+// recordAction appends an accepted cell action to the round's replay log.
+// Actions that changed nothing are left out.
+func (h *GameHub) recordAction(action CellAction, updates *UpdateResult) {
+	if len(updates.CellUpdates) == 0 && len(updates.ScoreboardUpdates) == 0 {
+		return
+	}
+
+	h.roundActions = append(h.roundActions, db.ReplayAction{
+		At:       time.Since(h.roundStartedAt).Milliseconds(),
+		Type:     action.Type,
+		X:        action.X,
+		Y:        action.Y,
+		PlayerID: action.PlayerID,
+	})
+}
+
+// recordMatch queues the finished round for storage. Writing happens on a
+// separate goroutine so gameplay never waits on the database.
+func (h *GameHub) recordMatch() {
+	match := h.buildMatchRecord()
+	record := &roundRecord{
+		match:  match,
+		replay: h.buildReplay(match),
+	}
+
+	select {
+	case h.matchRecords <- record:
+	default:
+		log.Printf("Match record queue full, dropping round started at %s", match.StartedAt.Format(time.RFC3339))
+	}
+}
+
+func (h *GameHub) buildReplay(match *db.Match) *db.Replay {
+	players := make([]db.ReplayPlayer, 0, len(match.Participants))
+	for _, participant := range match.Participants {
+		players = append(players, db.ReplayPlayer{
+			PlayerID:   participant.PlayerID,
+			PlayerName: participant.PlayerName,
+		})
+	}
+
+	return &db.Replay{
+		MatchID:   match.ID,
+		Config:    match.Config,
+		Mines:     match.Mines,
+		Revealed:  h.roundRevealed,
+		StartedAt: h.roundStartedAt,
+		Duration:  match.EndedAt.Sub(h.roundStartedAt).Milliseconds(),
+		Players:   players,
+		Actions:   h.roundActions,
+	}
+}
+
+func (h *GameHub) buildMatchRecord() *db.Match {
+	correctFlags := make(map[string]int)
+	mines := make([][2]int, 0)
+	for i, row := range h.GameBoard.Cells {
+		for j, cell := range row {
+			if !cell.IsMine {
+				continue
+			}
+			mines = append(mines, [2]int{i, j})
+			if cell.FlagState == Placed && cell.FlagOwnerID != "" {
+				correctFlags[cell.FlagOwnerID]++
+			}
+		}
+	}
+
+	now := time.Now()
+	participants := make([]db.MatchParticipant, 0, len(h.Players)+len(h.departedPlayers))
+	addParticipant := func(player Player) {
+		participants = append(participants, db.MatchParticipant{
+			PlayerID:     player.PlayerID,
+			PlayerName:   player.PlayerName,
+			IsLoggedIn:   player.IsLoggedIn,
+			Score:        player.Score,
+			Reveals:      player.TotalReveals,
+			MineHits:     player.TotalMineHits,
+			Flags:        player.ActiveFlagCount,
+			CorrectFlags: correctFlags[player.PlayerID],
+			PlayTime:     player.timePlayed(now).Milliseconds(),
+		})
+	}
+	for _, player := range h.departedPlayers {
+		addParticipant(player)
+	}
+	for _, player := range h.Players {
+		addParticipant(*player)
+	}
+
+	return &db.Match{
+		ID:           primitive.NewObjectID(),
+		Config:       CurrentBoardConfig(),
+		Seed:         h.Seed,
+		StartedAt:    h.roundStartedAt,
+		EndedAt:      now,
+		Mines:        mines,
+		FinalBoard:   EncodeBoardRows(h.GameBoard.Cells),
+		Participants: participants,
+	}
+}
+
+// EncodeBoardRows renders the board as one string per row: '0'-'8' for a
+// revealed cell, 'X' for a mine that was hit, 'F' for a flagged mine, 'f'
+// for a flag on a safe cell, '*' for a hidden mine and '.' for a hidden
+// safe cell
+func EncodeBoardRows(cells [][]Cell) []string {
+	rows := make([]string, len(cells))
+	for i, row := range cells {
+		line := make([]byte, len(row))
+		for j, cell := range row {
+			switch {
+			case cell.IsRevealed && cell.IsMine:
+				line[j] = 'X'
+			case cell.IsRevealed:
+				line[j] = byte('0' + cell.AdjacentMines)
+			case cell.FlagState == Placed && cell.IsMine:
+				line[j] = 'F'
+			case cell.FlagState == Placed:
+				line[j] = 'f'
+			case cell.IsMine:
+				line[j] = '*'
+			default:
+				line[j] = '.'
+			}
+		}
+		rows[i] = string(line)
+	}
+	return rows
+}
+
+// CurrentBoardConfig returns the rules rounds are currently played with
+func CurrentBoardConfig() db.BoardConfig {
+	return db.BoardConfig{
+		Size:            GAMEBOARD_SIZE,
+		MinesMultiplier: MINES_MULTIPLIER,
+		RevealReward:    REVEAL_REWARD,
+		MineHitPenalty:  MINE_HIT_PENALTY,
+	}
+}
+
+// writeMatchRecords stores queued match records until the queue is closed
+func (h *GameHub) writeMatchRecords() {
+	for record := range h.matchRecords {
+		if record.flushed != nil {
+			close(record.flushed)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), matchWriteTimeout)
+		if record.claim != nil {
+			h.claimGuestRounds(ctx, record.claim)
+			cancel()
+			continue
+		}
+
+		if err := h.store.Matches.Insert(ctx, record.match); err != nil {
+			// Without the match there is nothing the stats could be
+			// checked or rebuilt against
+			log.Printf("Failed to store match record: %v", err)
+			cancel()
+			continue
+		}
+		if err := h.store.Replays.Insert(ctx, record.replay); err != nil {
+			log.Printf("Failed to store replay for match %s: %v", record.match.ID.Hex(), err)
+		}
+		h.updateUserStats(ctx, record.match)
+		cancel()
+	}
+}
+
+// flushMatchRecords waits until the rounds queued so far are stored
+func (h *GameHub) flushMatchRecords(ctx context.Context) error {
+	flushed := make(chan struct{})
+	select {
+	case h.matchRecords <- &roundRecord{flushed: flushed}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// updateUserStats adds the round to the lifetime stats of every logged-in
+// participant
+func (h *GameHub) updateUserStats(ctx context.Context, match *db.Match) {
+	for _, participant := range match.Participants {
+		if !participant.IsLoggedIn {
+			continue
+		}
+
+		if err := h.store.Stats.RecordResult(ctx, participant.PlayerID, participant, wonMatch(match, participant), playTime(match, participant)); err != nil {
+			log.Printf("Failed to update stats for user %s: %v", participant.PlayerID, err)
+		}
+	}
+}
+
+// playTime is how long a participant was in the round. Rounds stored
+// before that was recorded count the whole round.
+func playTime(match *db.Match, participant db.MatchParticipant) time.Duration {
+	if participant.PlayTime == 0 {
+		return match.EndedAt.Sub(match.StartedAt)
+	}
+	return time.Duration(participant.PlayTime) * time.Millisecond
+}
+
+// wonMatch reports whether a participant won the round. The highest
+// scorers win, as long as they scored at all.
+func wonMatch(match *db.Match, participant db.MatchParticipant) bool {
+	topScore := 0
+	for _, other := range match.Participants {
+		topScore = max(topScore, other.Score)
+	}
+	return topScore > 0 && participant.Score == topScore
+}
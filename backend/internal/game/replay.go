@@ -0,0 +1,274 @@
+package game
+
+import (
+	"log"
+	"slices"
+	"time"
+
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/db"
+	"github.com/gorilla/websocket"
+)
+
+// ReplaySpeeds are the playback speeds a replay session accepts
+var ReplaySpeeds = []float64{1, 2, 8}
+
+// ReplayControl is a message from a replay viewer. Type is one of PAUSE,
+// RESUME, SPEED (with Speed) or SEEK (with At, in milliseconds).
+type ReplayControl struct {
+	Type  string  `json:"type"`
+	At    int64   `json:"at"`
+	Speed float64 `json:"speed"`
+}
+
+// ReplayState tells the viewer where playback is
+type ReplayState struct {
+	Position int64   `json:"position"`
+	Duration int64   `json:"duration"`
+	Speed    float64 `json:"speed"`
+	Paused   bool    `json:"paused"`
+	Ended    bool    `json:"ended"`
+}
+
+// ReplaySession plays a recorded round back to a single websocket viewer.
+// Every action is re-applied to a simulated board, so viewers receive the
+// same CELL updates live players saw and can seek to any point.
+type ReplaySession struct {
+	conn   *websocket.Conn
+	codec  Codec
+	replay *db.Replay
+
+	sim  *GameHub
+	next int
+
+	speed     float64
+	paused    bool
+	offset    int64
+	resumedAt time.Time
+}
+
+func NewReplaySession(conn *websocket.Conn, codec Codec, replay *db.Replay) *ReplaySession {
+	return &ReplaySession{
+		conn:   conn,
+		codec:  codec,
+		replay: replay,
+		speed:  1,
+	}
+}
+
+// Run streams the replay until the viewer disconnects
+func (s *ReplaySession) Run() {
+	defer s.conn.Close()
+
+	controls := make(chan ReplayControl)
+	done := make(chan struct{})
+	defer close(done)
+	go s.readControls(controls, done)
+
+	ping := time.NewTicker(pingPeriod)
+	defer ping.Stop()
+
+	if err := s.seek(0); err != nil {
+		return
+	}
+
+	for {
+		var timer *time.Timer
+		var due <-chan time.Time
+		if !s.paused && s.next < len(s.replay.Actions) {
+			wait := float64(s.replay.Actions[s.next].At-s.position()) / s.speed
+			timer = time.NewTimer(time.Duration(max(wait, 0) * float64(time.Millisecond)))
+			due = timer.C
+		}
+
+		select {
+		case <-due:
+			if err := s.playDueActions(); err != nil {
+				return
+			}
+		case control, ok := <-controls:
+			if !ok {
+				return
+			}
+			if err := s.handleControl(control); err != nil {
+				return
+			}
+		case <-ping.C:
+			s.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := s.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (s *ReplaySession) readControls(controls chan<- ReplayControl, done <-chan struct{}) {
+	defer close(controls)
+
+	s.conn.SetReadLimit(1024)
+	s.conn.SetReadDeadline(time.Now().Add(pongWait))
+	s.conn.SetPongHandler(func(string) error {
+		s.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	for {
+		_, message, err := s.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var control ReplayControl
+		if err := s.codec.Decode(message, &control); err != nil {
+			log.Printf("Replay: failed to decode control message: %v", err)
+			continue
+		}
+		select {
+		case controls <- control:
+		case <-done:
+			return
+		}
+	}
+}
+
+func (s *ReplaySession) handleControl(control ReplayControl) error {
+	switch control.Type {
+	case "PAUSE":
+		if !s.paused {
+			s.offset = s.position()
+			s.paused = true
+		}
+	case "RESUME":
+		if s.paused {
+			s.paused = false
+			s.resumedAt = time.Now()
+		}
+	case "SPEED":
+		if !slices.Contains(ReplaySpeeds, control.Speed) {
+			return s.send("ERROR", ErrorPayload{Code: "INVALID_SPEED", Message: "Speed must be 1, 2 or 8"})
+		}
+		s.offset = s.position()
+		s.resumedAt = time.Now()
+		s.speed = control.Speed
+	case "SEEK":
+		return s.seek(control.At)
+	default:
+		return nil
+	}
+
+	return s.sendState()
+}
+
+// position returns the playback position in milliseconds from round start
+func (s *ReplaySession) position() int64 {
+	position := s.offset
+	if !s.paused {
+		position += int64(float64(time.Since(s.resumedAt).Milliseconds()) * s.speed)
+	}
+	return min(position, s.replay.Duration)
+}
+
+// seek re-simulates the round from its initial board up to the given
+// position and sends the resulting board to the viewer
+func (s *ReplaySession) seek(at int64) error {
+	at = min(max(at, 0), s.replay.Duration)
+
+	s.sim = newReplaySimulation(s.replay)
+	s.next = 0
+	for s.next < len(s.replay.Actions) && s.replay.Actions[s.next].At <= at {
+		s.sim.applyCellAction(replayCellAction(s.replay.Actions[s.next]))
+		s.next++
+	}
+	s.sim.endIfCleared()
+
+	s.offset = at
+	s.resumedAt = time.Now()
+
+	if err := s.send("GAMEBOARD_STATE", s.sim.GetGameBoardState()); err != nil {
+		return err
+	}
+	return s.sendState()
+}
+
+// playDueActions applies every action whose time has come
+func (s *ReplaySession) playDueActions() error {
+	position := s.position()
+	for s.next < len(s.replay.Actions) && s.replay.Actions[s.next].At <= position {
+		updates := s.sim.applyCellAction(replayCellAction(s.replay.Actions[s.next]))
+		s.next++
+
+		if err := s.send("CELL", updates.toMap()); err != nil {
+			return err
+		}
+	}
+
+	if s.next == len(s.replay.Actions) {
+		s.sim.endIfCleared()
+		return s.sendState()
+	}
+	return nil
+}
+
+func (s *ReplaySession) sendState() error {
+	return s.send("REPLAY_STATE", ReplayState{
+		Position: s.position(),
+		Duration: s.replay.Duration,
+		Speed:    s.speed,
+		Paused:   s.paused,
+		Ended:    s.next == len(s.replay.Actions),
+	})
+}
+
+func (s *ReplaySession) send(messageType string, payload any) error {
+	data, err := NewMessage(messageType, payload).Encode(s.codec)
+	if err != nil {
+		log.Printf("Replay: failed to encode %s message: %v", messageType, err)
+		return nil
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return s.conn.WriteMessage(s.codec.FrameType(), data)
+}
+
+// newReplaySimulation returns a hub holding the round's initial board. It
+// is never run; actions are applied to it directly.
+func newReplaySimulation(replay *db.Replay) *GameHub {
+	board := NewGameBoardFromMines(replay.Mines)
+	revealCells(board, replay.Revealed)
+
+	sim := &GameHub{
+		GameBoard:  *board,
+		Players:    make(map[string]*Player),
+		StartTime:  replay.StartedAt.Unix(),
+		GameStatus: InProgress,
+	}
+
+	for _, player := range replay.Players {
+		sim.Players[player.PlayerID] = &Player{
+			PlayerID:   player.PlayerID,
+			PlayerName: player.PlayerName,
+		}
+	}
+
+	return sim
+}
+
+// endIfCleared marks a simulated round as ended once every safe cell has
+// been revealed, without scheduling a restart like CheckWinCondition
+func (h *GameHub) endIfCleared() {
+	if h.GameBoard.CellsToReveal == 0 {
+		h.GameStatus = Ended
+	}
+}
+
+func replayCellAction(action db.ReplayAction) CellAction {
+	return CellAction{
+		Type:     action.Type,
+		X:        action.X,
+		Y:        action.Y,
+		PlayerID: action.PlayerID,
+	}
+}
@@ -0,0 +1,146 @@
+package game
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/db"
+)
+
+const snapshotTimeout = 5 * time.Second
+
+// buildSnapshot captures the current round. It must be called from Run or
+// with BoardLock held.
+func (h *GameHub) buildSnapshot() *db.RoomSnapshot {
+	now := time.Now()
+	snapshot := &db.RoomSnapshot{
+		RoomID:          h.Config.RoomID,
+		Seed:            h.Seed,
+		StartedAt:       h.roundStartedAt,
+		GameStatus:      int(h.GameStatus),
+		RestartTime:     h.RestartTime,
+		Mines:           make([][2]int, 0),
+		Revealed:        make([][2]int, 0),
+		Flags:           make([]db.SnapshotFlag, 0),
+		Players:         make([]db.SnapshotPlayer, 0, len(h.Players)+len(h.departedPlayers)),
+		Actions:         append([]db.ReplayAction(nil), h.roundActions...),
+		InitialRevealed: h.roundRevealed,
+		SavedAt:         now,
+	}
+
+	for i, row := range h.GameBoard.Cells {
+		for j, cell := range row {
+			if cell.IsMine {
+				snapshot.Mines = append(snapshot.Mines, [2]int{i, j})
+			}
+			if cell.IsRevealed {
+				snapshot.Revealed = append(snapshot.Revealed, [2]int{i, j})
+			}
+			if cell.FlagState == Placed {
+				snapshot.Flags = append(snapshot.Flags, db.SnapshotFlag{X: i, Y: j, OwnerID: cell.FlagOwnerID})
+			}
+		}
+	}
+
+	addPlayer := func(player Player) {
+		snapshot.Players = append(snapshot.Players, db.SnapshotPlayer{
+			PlayerID:        player.PlayerID,
+			PlayerName:      player.PlayerName,
+			IsLoggedIn:      player.IsLoggedIn,
+			Score:           player.Score,
+			TotalReveals:    player.TotalReveals,
+			TotalMineHits:   player.TotalMineHits,
+			ActiveFlagCount: player.ActiveFlagCount,
+			PlayTime:        player.timePlayed(now).Milliseconds(),
+		})
+	}
+	for _, player := range h.departedPlayers {
+		addPlayer(player)
+	}
+	for _, player := range h.Players {
+		addPlayer(*player)
+	}
+
+	return snapshot
+}
+
+// queueSnapshot hands a snapshot to the background writer. If the writer is
+// still busy with the previous one, this one is skipped; the next interval
+// will catch up.
+func (h *GameHub) queueSnapshot() {
+	select {
+	case h.snapshots <- h.buildSnapshot():
+	default:
+		log.Println("Snapshot writer busy, skipping snapshot")
+	}
+}
+
+// writeSnapshots stores queued snapshots until the queue is closed
+func (h *GameHub) writeSnapshots() {
+	for snapshot := range h.snapshots {
+		h.saveSnapshot(snapshot)
+	}
+}
+
+func (h *GameHub) saveSnapshot(snapshot *db.RoomSnapshot) {
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+	defer cancel()
+
+	if err := h.store.Snapshots.Save(ctx, snapshot); err != nil {
+		log.Printf("Failed to save snapshot of room %s: %v", snapshot.RoomID, err)
+	}
+}
+
+// RestoreSnapshot resumes the round saved for this room, if any. It must be
+// called before Run. Players from the snapshot are kept as departed players
+// so their results carry on when they reconnect. Only players with an
+// account can reconnect as themselves; a guest's results stay on the
+// scoreboard but a returning guest starts over under a new ID.
+func (h *GameHub) RestoreSnapshot() error {
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+	defer cancel()
+
+	snapshot, err := h.store.Snapshots.Load(ctx, h.Config.RoomID)
+	if err != nil || snapshot == nil {
+		return err
+	}
+
+	board := NewGameBoardFromMines(snapshot.Mines)
+	revealCells(board, snapshot.Revealed)
+	for _, flag := range snapshot.Flags {
+		if isValidCoordinate(flag.X, flag.Y) {
+			board.Cells[flag.X][flag.Y].FlagState = Placed
+			board.Cells[flag.X][flag.Y].FlagOwnerID = flag.OwnerID
+		}
+	}
+
+	h.GameBoard = *board
+	h.Seed = snapshot.Seed
+	h.roundStartedAt = snapshot.StartedAt
+	h.StartTime = snapshot.StartedAt.Unix()
+	h.GameStatus = GameStatus(snapshot.GameStatus)
+	h.RestartTime = snapshot.RestartTime
+	h.roundActions = snapshot.Actions
+	h.roundRevealed = snapshot.InitialRevealed
+
+	for _, player := range snapshot.Players {
+		h.departedPlayers[player.PlayerID] = Player{
+			PlayerID:        player.PlayerID,
+			PlayerName:      player.PlayerName,
+			IsLoggedIn:      player.IsLoggedIn,
+			Score:           player.Score,
+			TotalReveals:    player.TotalReveals,
+			TotalMineHits:   player.TotalMineHits,
+			ActiveFlagCount: player.ActiveFlagCount,
+			playTime:        time.Duration(player.PlayTime) * time.Millisecond,
+		}
+	}
+
+	if h.GameStatus == Ended {
+		h.scheduleRestart(h.round, time.Until(time.Unix(h.RestartTime, 0)))
+	}
+
+	log.Printf("Restored room %s from snapshot saved at %s", h.Config.RoomID, snapshot.SavedAt.Format(time.RFC3339))
+	return nil
+}
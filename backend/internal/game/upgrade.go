@@ -0,0 +1,228 @@
+package game
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"log"
+
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/db"
+)
+
+var (
+	ErrGuestNotFound = errors.New("no guest is connected with that token")
+	ErrAccountInRoom = errors.New("account is already playing in this room")
+)
+
+// GuestSession is sent to a guest when it joins. The guest token is only
+// ever sent to that guest.
+type GuestSession struct {
+	PlayerID   string `json:"playerID"`
+	GuestToken string `json:"guestToken"`
+}
+
+// GuestUpgraded tells a guest its new player ID after it upgraded
+type GuestUpgraded struct {
+	PreviousPlayerID string `json:"previousPlayerID"`
+	Player           Player `json:"player"`
+}
+
+// Account is the account a guest is upgrading to
+type Account struct {
+	UserID    string
+	SessionID string
+	Name      string
+}
+
+// guestClaim moves a guest's recorded rounds to an account
+type guestClaim struct {
+	guestID string
+	account Account
+}
+
+// startGuestSession gives a guest a token to upgrade with later. It must be
+// called with BoardLock held.
+func (h *GameHub) startGuestSession(client *Client) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("Failed to create guest token for player %s: %v", client.PlayerID, err)
+		return
+	}
+	client.guestToken = base64.RawURLEncoding.EncodeToString(b)
+
+	h.deliver(client, NewMessage("GUEST_SESSION", GuestSession{
+		PlayerID:   client.PlayerID,
+		GuestToken: client.guestToken,
+	}))
+}
+
+// UpgradeGuest rebinds the connected guest holding guestToken to an
+// account it just registered or logged in to, without disconnecting it.
+// The guest's results in the current round move to the account, and the
+// rounds it finished earlier on this connection are attached to the
+// account in the background. It returns the guest's previous player ID.
+func (h *GameHub) UpgradeGuest(guestToken string, account Account) (string, error) {
+	guestID, err := h.rebindGuest(guestToken, account)
+	if err != nil {
+		return "", err
+	}
+
+	// Rounds are written in order on the same queue, so this runs after any
+	// round the guest finished is stored. The queue is only full while the
+	// writer catches up, so wait for room rather than lose the claim, but
+	// outside BoardLock so the round carries on meanwhile.
+	h.matchRecords <- &roundRecord{claim: &guestClaim{guestID: guestID, account: account}}
+
+	log.Printf("Guest %s upgraded to account %s", guestID, account.UserID)
+	return guestID, nil
+}
+
+// rebindGuest moves the connected guest holding guestToken and its results
+// in the current round to account, returning the guest's player ID
+func (h *GameHub) rebindGuest(guestToken string, account Account) (string, error) {
+	h.BoardLock.Lock()
+	defer h.BoardLock.Unlock()
+
+	client := h.guestByToken(guestToken)
+	if client == nil {
+		return "", ErrGuestNotFound
+	}
+	if _, ok := h.Clients[account.UserID]; ok {
+		return "", ErrAccountInRoom
+	}
+
+	guestID := client.PlayerID
+	player, ok := h.Players[guestID]
+	if !ok {
+		return "", ErrGuestNotFound
+	}
+
+	h.BroadcastUpdates("UNREGISTER", map[string]ScoreboardAction{
+		"scoreboardUpdates": {Type: "UNREGISTER", Player: *player},
+	})
+
+	// An account that left earlier in the round keeps those results too
+	if departed, ok := h.departedPlayers[account.UserID]; ok {
+		player.Score += departed.Score
+		player.TotalDefuses += departed.TotalDefuses
+		player.TotalReveals += departed.TotalReveals
+		player.TotalMineHits += departed.TotalMineHits
+		player.ActiveFlagCount += departed.ActiveFlagCount
+		player.playTime += departed.playTime
+		delete(h.departedPlayers, account.UserID)
+	}
+	player.PlayerID = account.UserID
+	player.PlayerName = account.Name
+	player.IsLoggedIn = true
+
+	delete(h.Players, guestID)
+	delete(h.Clients, guestID)
+	h.Players[account.UserID] = player
+	h.Clients[account.UserID] = client
+
+	client.idMu.Lock()
+	client.PlayerID = account.UserID
+	client.idMu.Unlock()
+	client.IsLoggedIn = true
+	client.SessionID = account.SessionID
+	client.PlayerName = account.Name
+	client.guestToken = ""
+
+	h.reassignRound(guestID, account.UserID)
+
+	h.BroadcastUpdates("REGISTER", map[string]ScoreboardAction{
+		"scoreboardUpdates": {Type: "REGISTER", Player: *player},
+	})
+	h.deliver(client, NewMessage("GUEST_UPGRADED", GuestUpgraded{
+		PreviousPlayerID: guestID,
+		Player:           *player,
+	}))
+
+	return guestID, nil
+}
+
+// guestByToken finds the guest connected with a token
+func (h *GameHub) guestByToken(guestToken string) *Client {
+	if guestToken == "" {
+		return nil
+	}
+
+	for _, client := range h.Clients {
+		if client.IsLoggedIn || client.guestToken == "" {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(client.guestToken), []byte(guestToken)) == 1 {
+			return client
+		}
+	}
+	return nil
+}
+
+// reassignRound moves a player's flags and logged actions in the current
+// round to a new player ID
+func (h *GameHub) reassignRound(fromID, toID string) {
+	for i := range h.GameBoard.Cells {
+		for j := range h.GameBoard.Cells[i] {
+			if h.GameBoard.Cells[i][j].FlagOwnerID == fromID {
+				h.GameBoard.Cells[i][j].FlagOwnerID = toID
+			}
+		}
+	}
+
+	for i := range h.roundActions {
+		if h.roundActions[i].PlayerID == fromID {
+			h.roundActions[i].PlayerID = toID
+		}
+	}
+
+	h.upgradedGuests[fromID] = toID
+}
+
+// claimGuestRounds attaches the stored rounds of a guest to the account it
+// upgraded to, and adds them to the account's stats
+func (h *GameHub) claimGuestRounds(ctx context.Context, claim *guestClaim) {
+	type result struct {
+		participant db.MatchParticipant
+		won         bool
+		match       *db.Match
+	}
+	results := make([]result, 0)
+
+	err := h.store.Matches.Each(ctx, db.MatchFilter{PlayerID: claim.guestID}, func(match *db.Match) error {
+		for _, participant := range match.Participants {
+			if participant.PlayerID == claim.guestID {
+				participant.PlayerID = claim.account.UserID
+				participant.PlayerName = claim.account.Name
+				participant.IsLoggedIn = true
+				results = append(results, result{participant, wonMatch(match, participant), match})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to load rounds of guest %s: %v", claim.guestID, err)
+		return
+	}
+	if len(results) == 0 {
+		return
+	}
+
+	to := db.ReplayPlayer{PlayerID: claim.account.UserID, PlayerName: claim.account.Name}
+	if err := h.store.Matches.Reassign(ctx, claim.guestID, to, true); err != nil {
+		log.Printf("Failed to attach rounds of guest %s to user %s: %v", claim.guestID, claim.account.UserID, err)
+		return
+	}
+	if err := h.store.Replays.Reassign(ctx, claim.guestID, to); err != nil {
+		log.Printf("Failed to attach replays of guest %s to user %s: %v", claim.guestID, claim.account.UserID, err)
+	}
+
+	for _, result := range results {
+		if err := h.store.Stats.RecordResult(ctx, claim.account.UserID, result.participant, result.won, playTime(result.match, result.participant)); err != nil {
+			log.Printf("Failed to update stats for user %s: %v", claim.account.UserID, err)
+		}
+	}
+
+	log.Printf("Attached %d rounds of guest %s to user %s", len(results), claim.guestID, claim.account.UserID)
+}
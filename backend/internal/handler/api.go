@@ -0,0 +1,12 @@
+package handler
+
+import "github.com/gameoflife0880/web_minesweeper/backend/internal/db"
+
+// API serves the stats, leaderboard, match and replay endpoints from Store
+type API struct {
+	Store *db.Store
+}
+
+func NewAPI(store *db.Store) *API {
+	return &API{Store: store}
+}
@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/auth"
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/game"
+)
+
+// maxLayoutSize bounds uploaded board layouts
+const maxLayoutSize = 64 << 10
+
+// ServeBoard serves GET /api/room/board?format=text|json&revealed=true,
+// the layout of the current round. It gives away the mines, so only room
+// hosts and admins may see it. It expects to be wrapped in auth.Handler.AuthMiddleware.
+func ServeBoard(hub *game.GameHub, w http.ResponseWriter, r *http.Request) {
+	if !isHost(hub, r) {
+		respondWithError(w, http.StatusForbidden, "Only room hosts can export the board")
+		return
+	}
+
+	layout := hub.CurrentLayout(r.URL.Query().Get("revealed") == "true")
+	respondWithLayout(w, r, layout)
+}
+
+// LoadBoard serves POST /api/room/board. The body is a layout in text form,
+// or JSON when sent as application/json. The current round is abandoned
+// and a new one starts on the uploaded board. It expects to be wrapped in
+// auth.Handler.AuthMiddleware.
+func LoadBoard(hub *game.GameHub, w http.ResponseWriter, r *http.Request) {
+	if !isHost(hub, r) {
+		respondWithError(w, http.StatusForbidden, "Only room hosts can load a board")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxLayoutSize))
+	if err != nil {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Board layout is too large")
+		return
+	}
+
+	var layout *game.BoardLayout
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		layout = &game.BoardLayout{}
+		err = json.Unmarshal(body, layout)
+	} else {
+		layout, err = game.ParseBoardLayout(body)
+	}
+	if err == nil {
+		err = layout.Validate()
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid board layout: "+err.Error())
+		return
+	}
+
+	hub.LoadLayout(layout)
+
+	userID, _ := auth.GetUserIDFromContext(r.Context())
+	log.Printf("Host %s loaded a board with %d mines", userID, len(layout.Mines))
+
+	respondWithLayout(w, r, layout)
+}
+
+// MatchBoardHandler serves GET /api/matches/{id}/board?format=text|json, the
+// mine layout a finished match was played on
+func (a *API) MatchBoardHandler(w http.ResponseWriter, r *http.Request) {
+	match, ok := a.loadMatch(w, r)
+	if !ok {
+		return
+	}
+
+	layout := &game.BoardLayout{
+		Width:  match.Config.Size,
+		Height: match.Config.Size,
+		Mines:  match.Mines,
+	}
+	respondWithLayout(w, r, layout)
+}
+
+// isHost reports whether the caller hosts the room. Admins host every room.
+func isHost(hub *game.GameHub, r *http.Request) bool {
+	userID, _ := auth.GetUserIDFromContext(r.Context())
+	return hub.Config.IsHost(userID) || auth.HasRole(r.Context(), auth.RoleAdmin)
+}
+
+// respondWithLayout writes the layout as text unless JSON was asked for
+func respondWithLayout(w http.ResponseWriter, r *http.Request, layout *game.BoardLayout) {
+	if r.URL.Query().Get("format") == "json" {
+		respondWithJSON(w, http.StatusOK, layout)
+		return
+	}
+
+	text, err := layout.Text()
+	if err != nil {
+		log.Printf("Error rendering board layout: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to render board")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(text)
+}
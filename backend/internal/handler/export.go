@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/export"
+)
+
+// ExportHandler serves GET /api/export?dataset=matches|results|actions&format=csv|ndjson&from=&to=&config=.
+// The export is streamed as it is read, so it has no page size. It expects
+// to be wrapped in auth.Handler.RequireRole(auth.RoleAdmin).
+func (a *API) ExportHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	options := export.Options{
+		Dataset:   export.Dataset(query.Get("dataset")),
+		Format:    export.Format(query.Get("format")),
+		ConfigKey: query.Get("config"),
+	}
+	if options.Dataset == "" {
+		options.Dataset = export.DatasetMatches
+	}
+	if options.Format == "" {
+		options.Format = export.FormatNDJSON
+	}
+	if err := options.Validate(); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	from, to, ok := parseDateRange(r)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Dates must be RFC 3339 or YYYY-MM-DD")
+		return
+	}
+	options.From, options.To = from, to
+
+	filename := fmt.Sprintf("%s-%s.%s", options.Dataset, time.Now().UTC().Format("20060102-150405"), options.Format)
+	w.Header().Set("Content-Type", options.Format.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+
+	// The status is already sent, so a failure can only cut the export short
+	if err := export.Write(r.Context(), w, a.Store, options); err != nil {
+		log.Printf("Export of %s failed: %v", options.Dataset, err)
+	}
+}
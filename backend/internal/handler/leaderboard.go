@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/auth"
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/db"
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/game"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+	// maxPage keeps the offset of a page far from overflowing
+	maxPage = 100000
+)
+
+type LeaderboardResponse struct {
+	Window   db.LeaderboardWindow  `json:"window"`
+	Config   string                `json:"config"`
+	Page     int                   `json:"page"`
+	PageSize int                   `json:"pageSize"`
+	Total    int                   `json:"total"`
+	Entries  []db.LeaderboardEntry `json:"entries"`
+	// Me is the caller's own entry, included for authenticated requests
+	Me *db.LeaderboardEntry `json:"me,omitempty"`
+}
+
+// LeaderboardHandler serves GET /api/leaderboard?window=daily|weekly|all&config=&page=&pageSize=.
+// It expects to be wrapped in auth.Handler.OptionalAuthMiddleware.
+func (a *API) LeaderboardHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	window := db.LeaderboardWindow(query.Get("window"))
+	if window == "" {
+		window = db.WindowAllTime
+	}
+	if _, err := window.Since(time.Now()); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Window must be daily, weekly or all")
+		return
+	}
+
+	configKey := query.Get("config")
+	if configKey == "" {
+		configKey = game.CurrentBoardConfig().Key()
+	}
+
+	page, pageSize, ok := parsePagination(r)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Invalid page or pageSize")
+		return
+	}
+
+	leaderboardQuery := db.LeaderboardQuery{
+		Window:    window,
+		ConfigKey: configKey,
+		Offset:    (page - 1) * pageSize,
+		Limit:     pageSize,
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	entries, total, err := a.Store.Matches.Leaderboard(ctx, leaderboardQuery)
+	if err != nil {
+		log.Printf("Error loading leaderboard: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to load leaderboard")
+		return
+	}
+
+	response := LeaderboardResponse{
+		Window:   window,
+		Config:   configKey,
+		Page:     page,
+		PageSize: pageSize,
+		Total:    total,
+		Entries:  entries,
+	}
+
+	if userID, ok := auth.GetUserIDFromContext(r.Context()); ok {
+		me, err := a.Store.Matches.LeaderboardRank(ctx, leaderboardQuery, userID)
+		if err != nil {
+			log.Printf("Error loading leaderboard rank for user %s: %v", userID, err)
+		}
+		response.Me = me
+	}
+
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+// parsePagination reads the 1-based page and page size query parameters.
+// Pages past maxPage are rejected.
+func parsePagination(r *http.Request) (page, pageSize int, ok bool) {
+	page, pageSize = 1, defaultPageSize
+
+	if value := r.URL.Query().Get("page"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxPage {
+			return 0, 0, false
+		}
+		page = n
+	}
+
+	if value := r.URL.Query().Get("pageSize"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxPageSize {
+			return 0, 0, false
+		}
+		pageSize = n
+	}
+
+	return page, pageSize, true
+}
@@ -0,0 +1,135 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/db"
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/export"
+)
+
+type MatchSummary struct {
+	ID               string               `json:"id"`
+	ConfigKey        string               `json:"config"`
+	StartedAt        time.Time            `json:"startedAt"`
+	EndedAt          time.Time            `json:"endedAt"`
+	ParticipantCount int                  `json:"participantCount"`
+	Result           *db.MatchParticipant `json:"result"`
+}
+
+type MatchHistoryResponse struct {
+	Page     int            `json:"page"`
+	PageSize int            `json:"pageSize"`
+	Total    int            `json:"total"`
+	Matches  []MatchSummary `json:"matches"`
+}
+
+// UserMatchesHandler serves GET /api/users/{id}/matches?from=&to=&config=&page=&pageSize=
+func (a *API) UserMatchesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("id")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if _, err := a.Store.Users.GetByID(ctx, userID); err != nil {
+		if err == db.ErrUserNotFound {
+			respondWithError(w, http.StatusNotFound, "User not found")
+			return
+		}
+		log.Printf("Error loading user %s: %v", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to load user")
+		return
+	}
+
+	page, pageSize, ok := parsePagination(r)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Invalid page or pageSize")
+		return
+	}
+
+	from, to, ok := parseDateRange(r)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Dates must be RFC 3339 or YYYY-MM-DD")
+		return
+	}
+
+	matches, total, err := a.Store.Matches.List(ctx, db.MatchFilter{
+		PlayerID:  userID,
+		From:      from,
+		To:        to,
+		ConfigKey: r.URL.Query().Get("config"),
+		Offset:    (page - 1) * pageSize,
+		Limit:     pageSize,
+	})
+	if err != nil {
+		log.Printf("Error loading matches for user %s: %v", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to load matches")
+		return
+	}
+
+	summaries := make([]MatchSummary, 0, len(matches))
+	for _, match := range matches {
+		summary := MatchSummary{
+			ID:               match.ID.Hex(),
+			ConfigKey:        match.ConfigKey,
+			StartedAt:        match.StartedAt,
+			EndedAt:          match.EndedAt,
+			ParticipantCount: len(match.Participants),
+		}
+		for i := range match.Participants {
+			if match.Participants[i].PlayerID == userID {
+				summary.Result = &match.Participants[i]
+				break
+			}
+		}
+		summaries = append(summaries, summary)
+	}
+
+	respondWithJSON(w, http.StatusOK, MatchHistoryResponse{
+		Page:     page,
+		PageSize: pageSize,
+		Total:    total,
+		Matches:  summaries,
+	})
+}
+
+// MatchHandler serves GET /api/matches/{id} with the full round summary
+func (a *API) MatchHandler(w http.ResponseWriter, r *http.Request) {
+	match, ok := a.loadMatch(w, r)
+	if !ok {
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, match)
+}
+
+// loadMatch loads the match named in the path, responding with an error if
+// it cannot
+func (a *API) loadMatch(w http.ResponseWriter, r *http.Request) (*db.Match, bool) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	match, err := a.Store.Matches.Get(ctx, r.PathValue("id"))
+	if err != nil {
+		if err == db.ErrMatchNotFound {
+			respondWithError(w, http.StatusNotFound, "Match not found")
+			return nil, false
+		}
+		log.Printf("Error loading match %s: %v", r.PathValue("id"), err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to load match")
+		return nil, false
+	}
+
+	return match, true
+}
+
+// parseDateRange reads the optional from and to query parameters. A bare
+// date for to includes that whole day.
+func parseDateRange(r *http.Request) (from, to time.Time, ok bool) {
+	query := r.URL.Query()
+
+	from, to, err := export.ParseDateRange(query.Get("from"), query.Get("to"))
+	return from, to, err == nil
+}
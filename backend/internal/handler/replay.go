@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/db"
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/game"
+)
+
+// ServeReplay streams a recorded match to the viewer over a websocket. The
+// viewer controls playback with PAUSE, RESUME, SPEED and SEEK messages.
+func (a *API) ServeReplay(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	replay, err := a.Store.Replays.Get(ctx, r.PathValue("id"))
+	if err != nil {
+		if err == db.ErrReplayNotFound {
+			respondWithError(w, http.StatusNotFound, "Replay not found")
+			return
+		}
+		log.Printf("Error loading replay %s: %v", r.PathValue("id"), err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to load replay")
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	session := game.NewReplaySession(conn, game.CodecForSubprotocol(conn.Subprotocol()), replay)
+	session.Run()
+}
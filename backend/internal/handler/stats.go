@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/auth"
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/db"
+)
+
+type UserStatsResponse struct {
+	UserID       string `json:"userID"`
+	Username     string `json:"username"`
+	GamesPlayed  int    `json:"gamesPlayed"`
+	Wins         int    `json:"wins"`
+	BestScore    int    `json:"bestScore"`
+	TotalReveals int    `json:"totalReveals"`
+	// Private is only included when users request their own stats
+	Private *PrivateUserStats `json:"private,omitempty"`
+}
+
+type PrivateUserStats struct {
+	TotalMineHits  int     `json:"totalMineHits"`
+	TotalFlags     int     `json:"totalFlags"`
+	FlagAccuracy   float64 `json:"flagAccuracy"`
+	AverageSeconds float64 `json:"averageSeconds"`
+}
+
+// UserStatsHandler returns a user's lifetime stats. It expects to be wrapped
+// in auth.Handler.OptionalAuthMiddleware so the owner can see private fields.
+func (a *API) UserStatsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("id")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	user, err := a.Store.Users.GetByID(ctx, userID)
+	if err != nil {
+		if err == db.ErrUserNotFound {
+			respondWithError(w, http.StatusNotFound, "User not found")
+			return
+		}
+		log.Printf("Error loading user %s: %v", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to load user")
+		return
+	}
+
+	stats, err := a.Store.Stats.Get(ctx, userID)
+	if err != nil {
+		log.Printf("Error loading stats for user %s: %v", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to load stats")
+		return
+	}
+
+	response := UserStatsResponse{
+		UserID:       userID,
+		Username:     user.Username,
+		GamesPlayed:  stats.GamesPlayed,
+		Wins:         stats.Wins,
+		BestScore:    stats.BestScore,
+		TotalReveals: stats.TotalReveals,
+	}
+
+	if callerID, ok := auth.GetUserIDFromContext(r.Context()); ok && callerID == userID {
+		response.Private = &PrivateUserStats{
+			TotalMineHits:  stats.TotalMineHits,
+			TotalFlags:     stats.TotalFlags,
+			FlagAccuracy:   stats.FlagAccuracy(),
+			AverageSeconds: stats.AverageSeconds(),
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/auth"
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/game"
+)
+
+type UpgradeGuestRequest struct {
+	// GuestToken is the token the guest received in its GUEST_SESSION
+	// message
+	GuestToken string `json:"guestToken"`
+}
+
+type UpgradeGuestResponse struct {
+	PlayerID         string `json:"playerID"`
+	PreviousPlayerID string `json:"previousPlayerID"`
+}
+
+// UpgradeGuest serves POST /api/room/upgrade. A guest that registers or
+// logs in mid-round calls it with its new token and its guest token, and
+// its open connection continues as the account. It expects to be wrapped
+// in auth.Handler.AuthMiddleware.
+func UpgradeGuest(hub *game.GameHub, authHandler *auth.Handler, w http.ResponseWriter, r *http.Request) {
+	var req UpgradeGuestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.GuestToken == "" {
+		respondWithError(w, http.StatusBadRequest, "Guest token is required")
+		return
+	}
+
+	userID, _ := auth.GetUserIDFromContext(r.Context())
+	sessionID, _ := auth.GetSessionIDFromContext(r.Context())
+
+	user, err := authHandler.GetUserByID(userID)
+	if err != nil {
+		if errors.Is(err, auth.ErrUserNotFound) {
+			respondWithError(w, http.StatusNotFound, "User not found")
+			return
+		}
+		log.Printf("Error loading user %s: %v", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to load user")
+		return
+	}
+
+	previousID, err := hub.UpgradeGuest(req.GuestToken, game.Account{
+		UserID:    userID,
+		SessionID: sessionID,
+		Name:      user.Name(),
+	})
+	if err != nil {
+		switch err {
+		case game.ErrGuestNotFound:
+			respondWithError(w, http.StatusNotFound, "No guest is connected with that token")
+		case game.ErrAccountInRoom:
+			respondWithError(w, http.StatusConflict, "Account is already playing in this room")
+		default:
+			log.Printf("Error upgrading guest to user %s: %v", userID, err)
+			respondWithError(w, http.StatusInternalServerError, "Failed to upgrade guest")
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, UpgradeGuestResponse{
+		PlayerID:         userID,
+		PreviousPlayerID: previousID,
+	})
+}
@@ -2,6 +2,7 @@ package handler
 
 import (
 	"log"
+	"net"
 	"net/http"
 	"slices"
 
@@ -16,6 +17,7 @@ var AllowedOrigins = []string{
 }
 
 var upgrader = websocket.Upgrader{
+	Subprotocols: game.Subprotocols,
 	CheckOrigin: func(r *http.Request) bool {
 		origin := r.Header.Get("Origin")
 
@@ -23,22 +25,34 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
-func ServeWs(hub *game.GameHub, w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+func ServeWs(hub *game.GameHub, authHandler *auth.Handler, w http.ResponseWriter, r *http.Request) {
+	upgrader := upgrader
+	upgrader.EnableCompression = hub.Config.Compression
+
+	conn, err := upgrader.Upgrade(countingResponseWriter{w}, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	var playerID string
+	var playerID, sessionID string
+	isLoggedIn := false
+	// Guests may pick a nickname; the hub validates it
+	playerName := r.URL.Query().Get("nickname")
 
 	token := r.URL.Query().Get("token")
 	if token != "" {
 		// Validate token
-		claims, err := auth.ValidateToken(token)
+		claims, err := authHandler.ValidateToken(token)
 		if err == nil {
 			// Token is valid, use user ID as player ID
 			playerID = claims.UserID
+			sessionID = claims.SessionID
+			isLoggedIn = true
+			playerName = claims.Username
+			if user, err := authHandler.GetUserByID(playerID); err == nil {
+				playerName = user.Name()
+			}
 			log.Printf("Authenticated user connected: %s (ID: %s)", claims.Username, playerID)
 		} else {
 			log.Printf("Invalid token provided: %v. Creating guest connection", err)
@@ -50,11 +64,12 @@ func ServeWs(hub *game.GameHub, w http.ResponseWriter, r *http.Request) {
 		log.Printf("Guest user connected: %s", playerID)
 	}
 
-	client := &game.Client{
-		Hub:      hub,
-		Conn:     conn,
-		Send:     make(chan []byte, 256),
-		PlayerID: playerID,
+	client := game.NewClient(hub, conn, game.CodecForSubprotocol(conn.Subprotocol()), playerID, remoteIP(r))
+	client.IsLoggedIn = isLoggedIn
+	client.SessionID = sessionID
+	client.PlayerName = playerName
+	if upgrader.EnableCompression && offersCompression(r) {
+		client.EnableCompression()
 	}
 
 	hub.Register <- client
@@ -62,3 +77,12 @@ func ServeWs(hub *game.GameHub, w http.ResponseWriter, r *http.Request) {
 	go client.ReadPump()
 	go client.WritePump()
 }
+
+// remoteIP returns the client address without its port
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
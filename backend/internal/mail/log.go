@@ -0,0 +1,59 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// LogMailer stands in for a real mailer during development and tests. It
+// logs every message with the query strings of its links redacted, as they
+// carry tokens, and if Dir is set also writes the full message there as an
+// .eml file.
+type LogMailer struct {
+	From string
+	Dir  string
+}
+
+func (m *LogMailer) Send(ctx context.Context, message Message) error {
+	if strings.ContainsAny(message.To+message.Subject, "\r\n") {
+		return errInvalidHeader
+	}
+
+	log.Printf("Email to %s: %s\n%s", message.To, message.Subject, redactLinks(message.Body))
+
+	if m.Dir == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102T150405.000000000"), sanitizeFilename(message.To))
+	return os.WriteFile(filepath.Join(m.Dir, name), format(m.From, message), 0o644)
+}
+
+// linkQuery matches the query string of a link
+var linkQuery = regexp.MustCompile(`(https?://[^\s?]*)\?\S*`)
+
+// redactLinks strips the query strings from the links in a body
+func redactLinks(body string) string {
+	return linkQuery.ReplaceAllString(body, "$1?[redacted]")
+}
+
+// sanitizeFilename keeps an address usable as part of a filename
+func sanitizeFilename(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '@', r == '.', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
@@ -0,0 +1,132 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	BackendSMTP = "smtp"
+	BackendLog  = "log"
+)
+
+const (
+	DefaultFrom     = "Minesweeper <no-reply@localhost>"
+	DefaultSMTPPort = 587
+)
+
+var (
+	errInvalidHeader = errors.New("email header contains a line break")
+	errLogBackend    = errors.New("the log mail backend delivers no email and is refused in production; set MAIL_BACKEND=smtp")
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends email
+type Mailer interface {
+	Send(ctx context.Context, message Message) error
+}
+
+// Config selects and configures how email is sent
+type Config struct {
+	Backend string
+	From    string
+
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+
+	// Dir is where the log mailer writes messages. Empty means they are only
+	// logged.
+	Dir string
+
+	// Production refuses the log mailer, which delivers nothing
+	Production bool
+}
+
+// LoadConfig reads the mail configuration from the environment.
+// MAIL_BACKEND is "log" (the default) or "smtp"; APP_ENV is "production"
+// in production, where the log backend is refused.
+func LoadConfig() Config {
+	backend := os.Getenv("MAIL_BACKEND")
+	if backend == "" {
+		backend = BackendLog
+	}
+
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = DefaultFrom
+	}
+
+	port := DefaultSMTPPort
+	if value := os.Getenv("SMTP_PORT"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			log.Printf("Invalid SMTP_PORT=%q, using default %d", value, DefaultSMTPPort)
+		} else {
+			port = n
+		}
+	}
+
+	return Config{
+		Backend:      backend,
+		From:         from,
+		SMTPHost:     os.Getenv("SMTP_HOST"),
+		SMTPPort:     port,
+		SMTPUsername: os.Getenv("SMTP_USERNAME"),
+		SMTPPassword: os.Getenv("SMTP_PASSWORD"),
+		Dir:          os.Getenv("MAIL_DIR"),
+		Production:   os.Getenv("APP_ENV") == "production",
+	}
+}
+
+// New returns the mailer for the configured backend
+func New(config Config) (Mailer, error) {
+	switch config.Backend {
+	case BackendSMTP:
+		if config.SMTPHost == "" {
+			return nil, fmt.Errorf("SMTP_HOST is required for the smtp mail backend")
+		}
+		return &SMTPMailer{
+			From:     config.From,
+			Host:     config.SMTPHost,
+			Port:     config.SMTPPort,
+			Username: config.SMTPUsername,
+			Password: config.SMTPPassword,
+		}, nil
+	case BackendLog:
+		if config.Production {
+			return nil, errLogBackend
+		}
+		log.Println("Using log mailer, email will not be delivered")
+		return &LogMailer{From: config.From, Dir: config.Dir}, nil
+	default:
+		return nil, fmt.Errorf("unknown mail backend %q", config.Backend)
+	}
+}
+
+// format renders a message with its headers, ready to be sent or saved
+func format(from string, message Message) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", message.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", message.Subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(message.Body)
+	return buf.Bytes()
+}
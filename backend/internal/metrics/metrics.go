@@ -0,0 +1,50 @@
+// Package metrics holds the server's runtime counters. They are published
+// through expvar, and served as JSON to admins at /api/metrics.
+package metrics
+
+import (
+	"expvar"
+	"sync"
+)
+
+var (
+	// SendQueueDepth is the number of messages waiting in all client send queues
+	SendQueueDepth = expvar.NewInt("ws_send_queue_depth")
+	// SendQueuePeak is the deepest a single client send queue has been
+	SendQueuePeak = expvar.NewInt("ws_send_queue_peak")
+	// SendQueueCollapses counts overflowing queues replaced by a board snapshot
+	SendQueueCollapses = expvar.NewInt("ws_send_queue_collapses")
+	// SlowClientDisconnects counts clients dropped for lagging too far behind
+	SlowClientDisconnects = expvar.NewInt("ws_slow_client_disconnects")
+	// RateLimitedActions counts client messages rejected by the rate limiter
+	RateLimitedActions = expvar.NewInt("ws_rate_limited_actions")
+	// RateLimitDisconnects counts clients dropped for sustained flooding
+	RateLimitDisconnects = expvar.NewInt("ws_rate_limit_disconnects")
+	// CompressedPayloadBytes is the uncompressed size of messages sent with
+	// permessage-deflate, and CompressedWireBytes what they took on the wire
+	CompressedPayloadBytes = expvar.NewInt("ws_compressed_payload_bytes")
+	CompressedWireBytes    = expvar.NewInt("ws_compressed_wire_bytes")
+	// FailedLogins counts logins rejected for a wrong username or password
+	FailedLogins = expvar.NewInt("auth_failed_logins")
+	// LoginLockouts counts usernames and IPs locked out after repeated
+	// failed logins
+	LoginLockouts = expvar.NewInt("auth_login_lockouts")
+)
+
+func init() {
+	expvar.Publish("ws_compression_bytes_saved", expvar.Func(func() any {
+		return CompressedPayloadBytes.Value() - CompressedWireBytes.Value()
+	}))
+}
+
+var maxMu sync.Mutex
+
+// SetMax raises v to n if n is larger than its current value
+func SetMax(v *expvar.Int, n int64) {
+	maxMu.Lock()
+	defer maxMu.Unlock()
+
+	if n > v.Value() {
+		v.Set(n)
+	}
+}
@@ -0,0 +1,124 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gameoflife0880/web_minesweeper/backend/internal/oidc/oidctest"
+)
+
+func newTestProvider(t *testing.T) (*Provider, *oidctest.Issuer) {
+	t.Helper()
+
+	issuer := oidctest.NewIssuer(t, "minesweeper")
+	provider := NewProvider(Config{
+		Name:        "test",
+		Issuer:      issuer.URL(),
+		ClientID:    issuer.ClientID,
+		Scopes:      DefaultScopes,
+		RedirectURL: "http://localhost/oidc/callback",
+	})
+	return provider, issuer
+}
+
+// login runs the flow up to the code exchange, sending exchangeVerifier
+// instead of the real verifier if set
+func login(t *testing.T, provider *Provider, issuer *oidctest.Issuer, identity oidctest.Identity, exchangeVerifier string) (*Claims, error) {
+	t.Helper()
+
+	ctx := context.Background()
+	state, _ := NewState()
+	nonce, _ := NewState()
+	verifier, _ := NewVerifier()
+
+	authorizationURL, err := provider.AuthCodeURL(ctx, state, nonce, verifier)
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	code, returnedState := issuer.Authorize(t, authorizationURL, identity)
+	if returnedState != state {
+		t.Fatalf("state = %q, want %q", returnedState, state)
+	}
+
+	if exchangeVerifier == "" {
+		exchangeVerifier = verifier
+	}
+	return provider.Exchange(ctx, code, exchangeVerifier, nonce)
+}
+
+func TestExchange(t *testing.T) {
+	tests := []struct {
+		name     string
+		identity oidctest.Identity
+		verifier string
+		wantErr  func(error) bool
+	}{
+		{
+			name:     "valid login",
+			identity: oidctest.Identity{Subject: "alice", Email: "alice@example.com", EmailVerified: true},
+		},
+		{
+			name:     "wrong PKCE verifier",
+			identity: oidctest.Identity{Subject: "alice"},
+			verifier: "not-the-verifier",
+			wantErr: func(err error) bool {
+				var tokenErr *TokenError
+				return errors.As(err, &tokenErr) && tokenErr.Code == "invalid_grant"
+			},
+		},
+		{
+			name:     "nonce mismatch",
+			identity: oidctest.Identity{Subject: "alice", Nonce: "replayed"},
+			wantErr: func(err error) bool {
+				return errors.Is(err, ErrInvalidIDToken)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider, issuer := newTestProvider(t)
+
+			claims, err := login(t, provider, issuer, tt.identity, tt.verifier)
+			if tt.wantErr != nil {
+				if err == nil || !tt.wantErr(err) {
+					t.Fatalf("Exchange error = %v, want a rejection", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Exchange: %v", err)
+			}
+			if claims.Subject != tt.identity.Subject || claims.Email != tt.identity.Email || claims.EmailVerified != tt.identity.EmailVerified {
+				t.Errorf("claims = %+v, want %+v", claims, tt.identity)
+			}
+		})
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	provider, issuer := newTestProvider(t)
+	identity := oidctest.Identity{Subject: "alice"}
+
+	if _, err := login(t, provider, issuer, identity, ""); err != nil {
+		t.Fatalf("login before rotation: %v", err)
+	}
+
+	issuer.RotateKey(t)
+
+	// Unknown key IDs only trigger a new fetch once the keys are old
+	// enough, so forged tokens cannot flood the provider
+	if _, err := login(t, provider, issuer, identity, ""); !errors.Is(err, ErrInvalidIDToken) {
+		t.Fatalf("login right after rotation error = %v, want %v", err, ErrInvalidIDToken)
+	}
+
+	provider.mu.Lock()
+	provider.keys.fetchedAt = time.Now().Add(-keyRefreshInterval)
+	provider.mu.Unlock()
+
+	if _, err := login(t, provider, issuer, identity, ""); err != nil {
+		t.Fatalf("login after rotation: %v", err)
+	}
+}
@@ -0,0 +1,224 @@
+// Package oidctest runs a minimal OpenID Connect provider for tests. It
+// serves discovery, keys and a token endpoint that checks PKCE, and skips
+// the login page: tests approve a login by calling Authorize with the URL
+// the client would send the user to.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Identity is the user a test logs in as
+type Identity struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+	// Nonce replaces the nonce the client asked for, to test that a
+	// mismatch is rejected
+	Nonce string
+}
+
+type grant struct {
+	clientID    string
+	redirectURI string
+	challenge   string
+	nonce       string
+	identity    Identity
+}
+
+// Issuer is a running mock provider
+type Issuer struct {
+	Server   *httptest.Server
+	ClientID string
+
+	mu     sync.Mutex
+	keyID  string
+	key    *rsa.PrivateKey
+	keys   map[string]*rsa.PrivateKey
+	grants map[string]grant
+	serial int
+}
+
+// NewIssuer starts a provider for clientID that is closed when the test
+// ends
+func NewIssuer(t testing.TB, clientID string) *Issuer {
+	t.Helper()
+
+	issuer := &Issuer{
+		ClientID: clientID,
+		keys:     make(map[string]*rsa.PrivateKey),
+		grants:   make(map[string]grant),
+	}
+	issuer.RotateKey(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", issuer.discovery)
+	mux.HandleFunc("GET /keys", issuer.jwks)
+	mux.HandleFunc("POST /token", issuer.token)
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Server.Close)
+
+	return issuer
+}
+
+// URL is the issuer URL to configure the client with
+func (i *Issuer) URL() string {
+	return i.Server.URL
+}
+
+// RotateKey signs new ID tokens with a new key. Old keys are no longer
+// published, as after a provider retires them.
+func (i *Issuer) RotateKey(t testing.TB) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.serial++
+	i.keyID = fmt.Sprintf("key-%d", i.serial)
+	i.key = key
+	clear(i.keys)
+	i.keys[i.keyID] = key
+}
+
+// Authorize approves the login at authorizationURL as identity and returns
+// the code and state the provider redirects back with
+func (i *Issuer) Authorize(t testing.TB, authorizationURL string, identity Identity) (code, state string) {
+	t.Helper()
+
+	parsed, err := url.Parse(authorizationURL)
+	if err != nil {
+		t.Fatalf("parsing authorization URL: %v", err)
+	}
+	query := parsed.Query()
+	if query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("authorization URL uses code challenge method %q", query.Get("code_challenge_method"))
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.serial++
+	code = fmt.Sprintf("code-%d", i.serial)
+	i.grants[code] = grant{
+		clientID:    query.Get("client_id"),
+		redirectURI: query.Get("redirect_uri"),
+		challenge:   query.Get("code_challenge"),
+		nonce:       query.Get("nonce"),
+		identity:    identity,
+	}
+	return code, query.Get("state")
+}
+
+func (i *Issuer) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":                 i.URL(),
+		"authorization_endpoint": i.URL() + "/authorize",
+		"token_endpoint":         i.URL() + "/token",
+		"jwks_uri":               i.URL() + "/keys",
+	})
+}
+
+func (i *Issuer) jwks(w http.ResponseWriter, r *http.Request) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	keys := make([]map[string]string, 0, len(i.keys))
+	for id, key := range i.keys {
+		keys = append(keys, map[string]string{
+			"kty": "RSA",
+			"kid": id,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"keys": keys})
+}
+
+func (i *Issuer) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		writeTokenError(w, "invalid_request")
+		return
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	code := r.PostForm.Get("code")
+	grant, ok := i.grants[code]
+	// Codes can only be redeemed once
+	delete(i.grants, code)
+	if !ok || grant.clientID != r.PostForm.Get("client_id") || grant.redirectURI != r.PostForm.Get("redirect_uri") {
+		writeTokenError(w, "invalid_grant")
+		return
+	}
+
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(challenge[:]) != grant.challenge {
+		writeTokenError(w, "invalid_grant")
+		return
+	}
+
+	nonce := grant.nonce
+	if grant.identity.Nonce != "" {
+		nonce = grant.identity.Nonce
+	}
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":                i.URL(),
+		"aud":                i.ClientID,
+		"sub":                grant.identity.Subject,
+		"iat":                now.Unix(),
+		"exp":                now.Add(time.Hour).Unix(),
+		"nonce":              nonce,
+		"email":              grant.identity.Email,
+		"email_verified":     grant.identity.EmailVerified,
+		"name":               grant.identity.Name,
+		"preferred_username": grant.identity.PreferredUsername,
+	})
+	token.Header["kid"] = i.keyID
+	idToken, err := token.SignedString(i.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"access_token": "access-" + code,
+		"token_type":   "Bearer",
+		"id_token":     idToken,
+	})
+}
+
+func writeTokenError(w http.ResponseWriter, code string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
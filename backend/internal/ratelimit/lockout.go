@@ -0,0 +1,158 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// LockoutPolicy decides how long a key is blocked after failed attempts.
+// The first FreeAttempts failures are not delayed. Each failure after that
+// blocks the key for BaseDelay, doubling every time up to MaxDelay, and
+// LockAfter failures lock it for LockDuration. Failures are forgotten once
+// a key has had none for ResetAfter.
+type LockoutPolicy struct {
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	LockAfter    int
+	LockDuration time.Duration
+	ResetAfter   time.Duration
+}
+
+// Failure describes a key after a failed attempt was recorded
+type Failure struct {
+	Failures     int
+	BlockedUntil time.Time
+	// Locked is set on the failure that locked the key
+	Locked bool
+}
+
+type lockoutEntry struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+	// pending counts attempts started but not yet failed or released
+	pending int
+}
+
+// Lockout counts failed attempts per key, such as a username or client IP,
+// and blocks keys that fail too often. It is safe for concurrent use.
+type Lockout struct {
+	mu        sync.Mutex
+	policy    LockoutPolicy
+	entries   map[string]*lockoutEntry
+	lastSweep time.Time
+}
+
+func NewLockout(policy LockoutPolicy) *Lockout {
+	return &Lockout{
+		policy:    policy,
+		entries:   make(map[string]*lockoutEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+// Attempt starts an attempt for key, or returns how long key must wait if
+// it may not try now. Once the free attempts are used up, only one attempt
+// may be pending at a time, so parallel attempts cannot get past the delays
+// by all checking before any of them fails. A started attempt must end with
+// Fail, Reset or Release.
+func (l *Lockout) Attempt(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		l.sweep(now)
+	}
+
+	entry, ok := l.entries[key]
+	if !ok || l.expired(entry, now) {
+		entry = &lockoutEntry{}
+		l.entries[key] = entry
+	}
+	if wait := entry.blockedUntil.Sub(now); wait > 0 {
+		return wait
+	}
+	if entry.pending > 0 && entry.failures+entry.pending >= l.policy.FreeAttempts {
+		return l.policy.BaseDelay
+	}
+
+	entry.pending++
+	return 0
+}
+
+// Release ends an attempt for key without counting it, such as when it
+// could not be checked
+func (l *Lockout) Release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if entry, ok := l.entries[key]; ok {
+		entry.pending = max(entry.pending-1, 0)
+	}
+}
+
+// Fail ends an attempt for key and records that it failed
+func (l *Lockout) Fail(key string) Failure {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	entry, ok := l.entries[key]
+	if !ok {
+		entry = &lockoutEntry{}
+		l.entries[key] = entry
+	} else if l.expired(entry, now) {
+		entry.failures = 0
+	}
+	entry.pending = max(entry.pending-1, 0)
+	entry.failures++
+	entry.lastFailure = now
+
+	failure := Failure{Failures: entry.failures}
+	switch {
+	case entry.failures >= l.policy.LockAfter:
+		failure.Locked = entry.failures == l.policy.LockAfter
+		entry.blockedUntil = now.Add(l.policy.LockDuration)
+	case entry.failures > l.policy.FreeAttempts:
+		delay := l.policy.BaseDelay << min(entry.failures-l.policy.FreeAttempts-1, 20)
+		entry.blockedUntil = now.Add(min(delay, l.policy.MaxDelay))
+	}
+	failure.BlockedUntil = entry.blockedUntil
+
+	return failure
+}
+
+// Reset forgets the failures of key, such as after a successful attempt.
+// Attempts still pending carry on.
+func (l *Lockout) Reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.entries[key]
+	if !ok {
+		return
+	}
+	if entry.pending == 0 {
+		delete(l.entries, key)
+		return
+	}
+	entry.failures = 0
+	entry.blockedUntil = time.Time{}
+}
+
+// expired reports whether an entry's failures can be forgotten and it has
+// no pending attempts
+func (l *Lockout) expired(entry *lockoutEntry, now time.Time) bool {
+	return entry.pending == 0 && now.Sub(entry.lastFailure) >= l.policy.ResetAfter && !now.Before(entry.blockedUntil)
+}
+
+func (l *Lockout) sweep(now time.Time) {
+	for key, entry := range l.entries {
+		if l.expired(entry, now) {
+			delete(l.entries, key)
+		}
+	}
+	l.lastSweep = now
+}
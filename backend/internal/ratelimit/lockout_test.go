@@ -0,0 +1,213 @@
+package ratelimit
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+var testPolicy = LockoutPolicy{
+	FreeAttempts: 3,
+	BaseDelay:    time.Second,
+	MaxDelay:     4 * time.Second,
+	LockAfter:    8,
+	LockDuration: time.Hour,
+	ResetAfter:   10 * time.Minute,
+}
+
+func TestLockoutFail(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		// wantBlock is how long the last failure blocks the key for
+		wantBlock  time.Duration
+		wantLocked bool
+	}{
+		{name: "free attempt", failures: 1},
+		{name: "last free attempt", failures: 3},
+		{name: "first delay", failures: 4, wantBlock: time.Second},
+		{name: "delay doubles", failures: 5, wantBlock: 2 * time.Second},
+		{name: "delay reaches the cap", failures: 6, wantBlock: 4 * time.Second},
+		{name: "delay stays at the cap", failures: 7, wantBlock: 4 * time.Second},
+		{name: "lock", failures: 8, wantBlock: time.Hour, wantLocked: true},
+		// Only the failure that locks the key reports it
+		{name: "failure while locked", failures: 9, wantBlock: time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLockout(testPolicy)
+
+			var failure Failure
+			before := time.Now()
+			for range tt.failures {
+				before = time.Now()
+				failure = l.Fail("alice")
+			}
+			after := time.Now()
+
+			if failure.Failures != tt.failures || failure.Locked != tt.wantLocked {
+				t.Fatalf("Fail = %+v, want %d failures and locked %t", failure, tt.failures, tt.wantLocked)
+			}
+			if tt.wantBlock == 0 {
+				if !failure.BlockedUntil.IsZero() {
+					t.Fatalf("blocked until %s, want not blocked", failure.BlockedUntil)
+				}
+				if wait := l.Attempt("alice"); wait != 0 {
+					t.Errorf("Attempt wait = %s, want none", wait)
+				}
+				return
+			}
+			if failure.BlockedUntil.Before(before.Add(tt.wantBlock)) || failure.BlockedUntil.After(after.Add(tt.wantBlock)) {
+				t.Fatalf("blocked for %s, want %s", failure.BlockedUntil.Sub(before), tt.wantBlock)
+			}
+			if wait := l.Attempt("alice"); wait <= 0 || wait > tt.wantBlock {
+				t.Errorf("Attempt wait = %s, want up to %s", wait, tt.wantBlock)
+			}
+		})
+	}
+}
+
+func TestLockoutParallelAttempts(t *testing.T) {
+	tests := []struct {
+		name string
+		// failures are recorded before the parallel attempts
+		failures    int
+		wantStarted int
+	}{
+		{name: "all attempts free", failures: 0, wantStarted: 3},
+		{name: "one free attempt left", failures: 2, wantStarted: 1},
+		// Past the free attempts each attempt must fail before the next
+		// one starts
+		{name: "free attempts used up", failures: 3, wantStarted: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLockout(testPolicy)
+			for range tt.failures {
+				l.Attempt("alice")
+				l.Fail("alice")
+			}
+
+			var (
+				wg      sync.WaitGroup
+				mu      sync.Mutex
+				started int
+			)
+			for range 20 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if l.Attempt("alice") == 0 {
+						mu.Lock()
+						started++
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+
+			if started != tt.wantStarted {
+				t.Fatalf("started %d attempts, want %d", started, tt.wantStarted)
+			}
+
+			// Ending the started attempts lets the next one through
+			for range started {
+				l.Release("alice")
+			}
+			if wait := l.Attempt("alice"); wait != 0 {
+				t.Errorf("Attempt after release wait = %s, want none", wait)
+			}
+		})
+	}
+}
+
+func TestLockoutReset(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		// pending attempts are started before the reset and fail after it
+		pending int
+	}{
+		{name: "no pending attempts", failures: 5},
+		{name: "pending attempt", failures: 2, pending: 1},
+		{name: "pending attempts while blocked", failures: 5, pending: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLockout(testPolicy)
+			for range tt.failures {
+				l.Fail("alice")
+			}
+			// Attempts started in parallel with the failing ones
+			l.entries["alice"].pending = tt.pending
+
+			l.Reset("alice")
+
+			_, kept := l.entries["alice"]
+			if kept != (tt.pending > 0) {
+				t.Fatalf("entry kept = %t, want %t", kept, tt.pending > 0)
+			}
+			// Failures of attempts pending across the reset count from
+			// the start
+			for i := range tt.pending {
+				if failure := l.Fail("alice"); failure.Failures != i+1 || !failure.BlockedUntil.IsZero() {
+					t.Fatalf("Fail after reset = %+v, want %d failures and no block", failure, i+1)
+				}
+			}
+			if wait := l.Attempt("alice"); wait != 0 {
+				t.Errorf("Attempt after reset wait = %s, want none", wait)
+			}
+		})
+	}
+}
+
+func TestLockoutExpiry(t *testing.T) {
+	tests := []struct {
+		name string
+		// age is how long ago the last failure and its block ended
+		age     time.Duration
+		pending int
+		// wantForgotten reports whether the failures no longer count
+		wantForgotten bool
+	}{
+		{name: "recent failures", age: testPolicy.ResetAfter / 2},
+		{name: "old failures", age: testPolicy.ResetAfter, wantForgotten: true},
+		{name: "old failures with a pending attempt", age: testPolicy.ResetAfter, pending: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLockout(testPolicy)
+			for range 5 {
+				l.Attempt("alice")
+				l.Fail("alice")
+			}
+			entry := l.entries["alice"]
+			entry.lastFailure = time.Now().Add(-tt.age)
+			entry.blockedUntil = entry.lastFailure
+			entry.pending = tt.pending
+
+			// Another key's attempt sweeps once the interval has passed
+			l.lastSweep = time.Now().Add(-sweepInterval)
+			l.Attempt("bob")
+
+			if _, kept := l.entries["alice"]; kept == tt.wantForgotten {
+				t.Fatalf("entry kept after sweep = %t, want %t", kept, !tt.wantForgotten)
+			}
+			if tt.wantForgotten {
+				return
+			}
+
+			// The kept failures still count towards the next block
+			if tt.pending == 0 {
+				l.Attempt("alice")
+			}
+			if failure := l.Fail("alice"); failure.Failures != 6 {
+				t.Errorf("Fail = %+v, want 6 failures", failure)
+			}
+		})
+	}
+}
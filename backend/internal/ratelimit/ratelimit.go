@@ -0,0 +1,127 @@
+// Package ratelimit provides token buckets for throttling clients.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket holding up to burst tokens and refilled at rate
+// tokens per second. It is safe for concurrent use.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewBucket(rate float64, burst int) *Bucket {
+	return &Bucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Allow takes a token from the bucket, reporting whether one was available
+func (b *Bucket) Allow() bool {
+	return AllowAll(b)
+}
+
+// AllowAll takes a token from every bucket if each of them has one, so an
+// action denied by one bucket costs nothing in the others. Buckets are
+// locked in the order given; callers sharing buckets must pass them in the
+// same order.
+func AllowAll(buckets ...*Bucket) bool {
+	now := time.Now()
+	allowed := true
+	for _, b := range buckets {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		b.refill(now)
+		if b.tokens < 1 {
+			allowed = false
+		}
+	}
+
+	if !allowed {
+		return false
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return true
+}
+
+// refill adds the tokens earned since the last call. It must be called with
+// mu held.
+func (b *Bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// idle reports whether the bucket has been full for at least d
+func (b *Bucket) idle(d time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return time.Since(b.last) >= d
+}
+
+const sweepInterval = time.Minute
+
+// Registry hands out one shared bucket per key, such as a client IP, and
+// forgets buckets that have not been used for a while. A forgotten bucket
+// was full, so callers should look their bucket up for every action rather
+// than keep it; a kept bucket would no longer be shared once swept.
+type Registry struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     int
+	buckets   map[string]*Bucket
+	lastSweep time.Time
+}
+
+func NewRegistry(rate float64, burst int) *Registry {
+	return &Registry{
+		rate:      rate,
+		burst:     burst,
+		buckets:   make(map[string]*Bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Get returns the bucket for key, creating it if needed
+func (r *Registry) Get(key string) *Bucket {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.lastSweep) >= sweepInterval {
+		r.sweep()
+	}
+
+	bucket, ok := r.buckets[key]
+	if !ok {
+		bucket = NewBucket(r.rate, r.burst)
+		r.buckets[key] = bucket
+	}
+	return bucket
+}
+
+// sweep drops buckets that have had time to refill completely, since a
+// fresh bucket would behave the same
+func (r *Registry) sweep() {
+	refill := time.Duration(float64(r.burst)/r.rate*float64(time.Second)) + sweepInterval
+	for key, bucket := range r.buckets {
+		if bucket.idle(refill) {
+			delete(r.buckets, key)
+		}
+	}
+	r.lastSweep = time.Now()
+}
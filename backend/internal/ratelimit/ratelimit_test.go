@@ -0,0 +1,57 @@
+package ratelimit
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAllowAll(t *testing.T) {
+	tests := []struct {
+		name string
+		// tokens is what each bucket holds before the call
+		tokens      []float64
+		wantAllowed bool
+		wantTokens  []float64
+	}{
+		{
+			name:        "every bucket has a token",
+			tokens:      []float64{3, 1},
+			wantAllowed: true,
+			wantTokens:  []float64{2, 0},
+		},
+		{
+			name:       "first bucket empty",
+			tokens:     []float64{0, 3},
+			wantTokens: []float64{0, 3},
+		},
+		{
+			name:       "last bucket empty",
+			tokens:     []float64{3, 3, 0.5},
+			wantTokens: []float64{3, 3, 0.5},
+		},
+		{
+			name:        "no buckets",
+			wantAllowed: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buckets := make([]*Bucket, len(tt.tokens))
+			for i, tokens := range tt.tokens {
+				// Nothing refills, so the tokens only change by being spent
+				buckets[i] = NewBucket(0, 3)
+				buckets[i].tokens = tokens
+			}
+
+			if allowed := AllowAll(buckets...); allowed != tt.wantAllowed {
+				t.Fatalf("AllowAll = %t, want %t", allowed, tt.wantAllowed)
+			}
+			for i, b := range buckets {
+				if math.Abs(b.tokens-tt.wantTokens[i]) > 1e-9 {
+					t.Errorf("bucket %d has %v tokens, want %v", i, b.tokens, tt.wantTokens[i])
+				}
+			}
+		})
+	}
+}
@@ -1,10 +1,21 @@
 package pkg
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
 )
 
+const (
+	MinNicknameLength = 3
+	MaxNicknameLength = 20
+)
+
+var (
+	ErrNicknameLength  = fmt.Errorf("nickname must be %d to %d characters", MinNicknameLength, MaxNicknameLength)
+	ErrNicknameCharset = errors.New("nickname may only contain letters, digits, '_' and '-'")
+)
+
 var adjectives = []string{
 	"Wacky", "Goofy", "Silly", "Funny", "Bouncy", "Cocky", "Awkward", "Fluffy", "Sassy",
 	"Clever", "Quiet", "Swift", "Calm", "Smooth", "Lucky", "Stealthy", "Chilly", "Electric",
@@ -25,3 +36,30 @@ func GenerateNickname() string {
 
 	return fmt.Sprintf("%s%s%d", adjective, noun, number)
 }
+
+// ValidateNickname checks a player-chosen name. It does not check that the
+// name is unused.
+func ValidateNickname(name string) error {
+	if len(name) < MinNicknameLength || len(name) > MaxNicknameLength {
+		return ErrNicknameLength
+	}
+
+	if !ValidNameCharset(name) {
+		return ErrNicknameCharset
+	}
+
+	return nil
+}
+
+// ValidNameCharset reports whether name only uses the characters allowed in
+// nicknames and usernames: ASCII letters, digits, '_' and '-'
+func ValidNameCharset(name string) bool {
+	for _, char := range name {
+		isLetter := (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z')
+		isDigit := char >= '0' && char <= '9'
+		if !isLetter && !isDigit && char != '_' && char != '-' {
+			return false
+		}
+	}
+	return true
+}